@@ -0,0 +1,450 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Minimal ACME (RFC 8555) client, only supporting what is needed to obtain
+// certificates using HTTP-01 challenges.
+
+const (
+	acmeStatusPending    = "pending"
+	acmeStatusProcessing = "processing"
+	acmeStatusReady      = "ready"
+	acmeStatusValid      = "valid"
+	acmeStatusInvalid    = "invalid"
+
+	acmeChallengeHTTP01 = "http-01"
+)
+
+var acmePollInterval = 2 * time.Second
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme error %s: %s", p.Type, p.Detail)
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	Status         string           `json:"status"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate"`
+	Error          *acmeProblem     `json:"error"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeClient struct {
+	directoryURL string
+	httpClient   *http.Client
+	key          *ecdsa.PrivateKey
+
+	// termsOfServiceAgreed must be set to register accounts, it means that
+	// the operator accepts the terms of service of the ACME server
+	termsOfServiceAgreed bool
+
+	directory  *acmeDirectory
+	accountURL string
+	nonces     []string
+}
+
+func newACMEClient(directoryURL string, key *ecdsa.PrivateKey, httpClient *http.Client) *acmeClient {
+	return &acmeClient{
+		directoryURL: directoryURL,
+		httpClient:   httpClient,
+		key:          key,
+	}
+}
+
+func base64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// jwk returns the JSON Web Key of the account key, with its members in
+// lexicographical order as required to calculate its thumbprint
+func (c *acmeClient) jwk() string {
+	size := (c.key.Curve.Params().BitSize + 7) / 8
+	x := make([]byte, size)
+	y := make([]byte, size)
+	xBytes := c.key.X.Bytes()
+	yBytes := c.key.Y.Bytes()
+	copy(x[size-len(xBytes):], xBytes)
+	copy(y[size-len(yBytes):], yBytes)
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, base64URL(x), base64URL(y))
+}
+
+// keyAuthorization returns the content expected by the ACME server in the
+// response to a challenge
+func (c *acmeClient) keyAuthorization(token string) string {
+	thumbprint := sha256.Sum256([]byte(c.jwk()))
+	return token + "." + base64URL(thumbprint[:])
+}
+
+func (c *acmeClient) sign(url string, payload []byte, nonce string) ([]byte, error) {
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+	if c.accountURL != "" {
+		protected["kid"] = c.accountURL
+	} else {
+		protected["jwk"] = json.RawMessage(c.jwk())
+	}
+	protectedJSON, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedPayload := ""
+	if payload != nil {
+		encodedPayload = base64URL(payload)
+	}
+	signingInput := base64URL(protectedJSON) + "." + encodedPayload
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rBytes):32], rBytes)
+	copy(signature[64-len(sBytes):], sBytes)
+
+	return json.Marshal(map[string]string{
+		"protected": base64URL(protectedJSON),
+		"payload":   encodedPayload,
+		"signature": base64URL(signature),
+	})
+}
+
+func (c *acmeClient) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.nonces = append(c.nonces, nonce)
+	}
+	return resp, nil
+}
+
+func (c *acmeClient) discover(ctx context.Context) error {
+	if c.directory != nil {
+		return nil
+	}
+	req, err := http.NewRequest("GET", c.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("couldn't get ACME directory: %s", resp.Status)
+	}
+	var directory acmeDirectory
+	if err := json.NewDecoder(resp.Body).Decode(&directory); err != nil {
+		return err
+	}
+	c.directory = &directory
+	return nil
+}
+
+func (c *acmeClient) nonce(ctx context.Context) (string, error) {
+	if len(c.nonces) > 0 {
+		nonce := c.nonces[len(c.nonces)-1]
+		c.nonces = c.nonces[:len(c.nonces)-1]
+		return nonce, nil
+	}
+	req, err := http.NewRequest("HEAD", c.directory.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("no nonce received from ACME server")
+	}
+	return nonce, nil
+}
+
+// post sends a signed request, if payload is nil it is a POST-as-GET request
+func (c *acmeClient) post(ctx context.Context, url string, payload []byte, result interface{}) (*http.Response, []byte, error) {
+	for retry := 0; ; retry++ {
+		nonce, err := c.nonce(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := c.sign(url, payload, nonce)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := c.do(ctx, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{Status: resp.StatusCode}
+			if err := json.Unmarshal(data, problem); err != nil {
+				return nil, nil, fmt.Errorf("unexpected ACME response: %s", resp.Status)
+			}
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && retry < 3 {
+				continue
+			}
+			return nil, nil, problem
+		}
+
+		if result != nil {
+			if err := json.Unmarshal(data, result); err != nil {
+				return nil, nil, err
+			}
+		}
+		return resp, data, nil
+	}
+}
+
+func (c *acmeClient) register(ctx context.Context, email string) error {
+	if err := c.discover(ctx); err != nil {
+		return err
+	}
+	if c.accountURL != "" {
+		return nil
+	}
+	if !c.termsOfServiceAgreed {
+		return fmt.Errorf("terms of service of the ACME server must be accepted to register an account")
+	}
+	account := map[string]interface{}{
+		"termsOfServiceAgreed": true,
+	}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	payload, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	resp, _, err := c.post(ctx, c.directory.NewAccount, payload, nil)
+	if err != nil {
+		return fmt.Errorf("couldn't register ACME account: %s", err)
+	}
+	c.accountURL = resp.Header.Get("Location")
+	if c.accountURL == "" {
+		return fmt.Errorf("no account URL received from ACME server")
+	}
+	return nil
+}
+
+func (c *acmeClient) waitAuthorization(ctx context.Context, url string) error {
+	for {
+		var authz acmeAuthorization
+		if _, _, err := c.post(ctx, url, nil, &authz); err != nil {
+			return err
+		}
+		switch authz.Status {
+		case acmeStatusValid:
+			return nil
+		case acmeStatusPending, acmeStatusProcessing:
+		default:
+			for _, challenge := range authz.Challenges {
+				if challenge.Error != nil {
+					return fmt.Errorf("authorization for %s failed: %s", authz.Identifier.Value, challenge.Error)
+				}
+			}
+			return fmt.Errorf("authorization for %s is %s", authz.Identifier.Value, authz.Status)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(acmePollInterval):
+		}
+	}
+}
+
+func (c *acmeClient) waitOrder(ctx context.Context, url string, order *acmeOrder, expected ...string) error {
+	for {
+		for _, status := range expected {
+			if order.Status == status {
+				return nil
+			}
+		}
+		switch order.Status {
+		case acmeStatusPending, acmeStatusProcessing, acmeStatusReady:
+		default:
+			if order.Error != nil {
+				return fmt.Errorf("order failed: %s", order.Error)
+			}
+			return fmt.Errorf("order is %s", order.Status)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(acmePollInterval):
+		}
+		if _, _, err := c.post(ctx, url, nil, order); err != nil {
+			return err
+		}
+	}
+}
+
+// obtain requests a certificate for the domains, the solve function is used
+// to publish the key authorizations of HTTP-01 challenges. It returns the
+// PEM encoded certificate chain and private key.
+func (c *acmeClient) obtain(ctx context.Context, domains []string, solve func(token, keyAuthorization string)) ([]byte, []byte, error) {
+	identifiers := make([]acmeIdentifier, len(domains))
+	for i, domain := range domains {
+		identifiers[i] = acmeIdentifier{Type: "dns", Value: domain}
+	}
+	payload, err := json.Marshal(map[string]interface{}{"identifiers": identifiers})
+	if err != nil {
+		return nil, nil, err
+	}
+	var order acmeOrder
+	resp, _, err := c.post(ctx, c.directory.NewOrder, payload, &order)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't create order: %s", err)
+	}
+	orderURL := resp.Header.Get("Location")
+
+	for _, authzURL := range order.Authorizations {
+		var authz acmeAuthorization
+		if _, _, err := c.post(ctx, authzURL, nil, &authz); err != nil {
+			return nil, nil, err
+		}
+		if authz.Status == acmeStatusValid {
+			continue
+		}
+		var challenge *acmeChallenge
+		for i := range authz.Challenges {
+			if authz.Challenges[i].Type == acmeChallengeHTTP01 {
+				challenge = &authz.Challenges[i]
+				break
+			}
+		}
+		if challenge == nil {
+			return nil, nil, fmt.Errorf("no HTTP-01 challenge offered for %s", authz.Identifier.Value)
+		}
+		solve(challenge.Token, c.keyAuthorization(challenge.Token))
+		if _, _, err := c.post(ctx, challenge.URL, []byte("{}"), nil); err != nil {
+			return nil, nil, err
+		}
+		if err := c.waitAuthorization(ctx, authzURL); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := c.waitOrder(ctx, orderURL, &order, acmeStatusReady); err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, err = json.Marshal(map[string]string{"csr": base64URL(csr)})
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, _, err := c.post(ctx, order.Finalize, payload, &order); err != nil {
+		return nil, nil, fmt.Errorf("couldn't finalize order: %s", err)
+	}
+	if err := c.waitOrder(ctx, orderURL, &order, acmeStatusValid); err != nil {
+		return nil, nil, err
+	}
+
+	_, chain, err := c.post(ctx, order.Certificate, nil, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't download certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return chain, keyPEM, nil
+}
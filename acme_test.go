@@ -0,0 +1,415 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// fakeACMEServer implements the subset of an ACME server used by kube2lb,
+// it validates challenges against the given challenges server
+type fakeACMEServer struct {
+	sync.Mutex
+	t *testing.T
+
+	server     *httptest.Server
+	challenges string
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	accountKey  *ecdsa.PublicKey
+	accountJWK  string
+	nonce       int
+	identifiers []acmeIdentifier
+	validated   map[int]bool
+	certificate []byte
+}
+
+func newFakeACMEServer(t *testing.T, challenges string) *fakeACMEServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeACMEServer{
+		t:          t,
+		challenges: challenges,
+		caKey:      caKey,
+		caCert:     caCert,
+		validated:  make(map[int]bool),
+	}
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+func (s *fakeACMEServer) url(path string) string {
+	return s.server.URL + path
+}
+
+// verify checks the signature of a JWS request and returns its payload
+func (s *fakeACMEServer) verify(r *http.Request) ([]byte, error) {
+	var jws struct {
+		Protected, Payload, Signature string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, err
+	}
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, err
+	}
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  json.RawMessage
+	}
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+		return nil, err
+	}
+	if protected.URL != s.url(r.URL.Path) {
+		return nil, fmt.Errorf("unexpected url in request: %s", protected.URL)
+	}
+	if protected.Nonce == "" {
+		return nil, fmt.Errorf("nonce expected")
+	}
+
+	if protected.JWK != nil {
+		var jwk struct{ X, Y string }
+		if err := json.Unmarshal(protected.JWK, &jwk); err != nil {
+			return nil, err
+		}
+		x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+		s.accountKey = &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		s.accountJWK = string(protected.JWK)
+	} else if protected.Kid != s.url("/account/1") {
+		return nil, fmt.Errorf("unknown account %s", protected.Kid)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || len(signature) != 64 {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	r1 := new(big.Int).SetBytes(signature[:32])
+	s1 := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(s.accountKey, digest[:], r1, s1) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return base64.RawURLEncoding.DecodeString(jws.Payload)
+}
+
+func (s *fakeACMEServer) order() map[string]interface{} {
+	order := map[string]interface{}{
+		"status":      acmeStatusReady,
+		"identifiers": s.identifiers,
+		"finalize":    s.url("/finalize/1"),
+	}
+	var authorizations []string
+	for i := range s.identifiers {
+		authorizations = append(authorizations, s.url(fmt.Sprintf("/authz/%d", i)))
+		if !s.validated[i] {
+			order["status"] = acmeStatusPending
+		}
+	}
+	order["authorizations"] = authorizations
+	if s.certificate != nil {
+		order["status"] = acmeStatusValid
+		order["certificate"] = s.url("/cert/1")
+	}
+	return order
+}
+
+func (s *fakeACMEServer) validate(i int) error {
+	token := fmt.Sprintf("token%d", i)
+	resp, err := http.Get(s.challenges + acmeChallengePath + token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	thumbprint := sha256.Sum256([]byte(s.accountJWK))
+	expected := token + "." + base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	if string(body) != expected {
+		return fmt.Errorf("unexpected key authorization %s, expected %s", body, expected)
+	}
+	s.validated[i] = true
+	return nil
+}
+
+func (s *fakeACMEServer) issue(payload []byte) error {
+	var finalize struct{ CSR string }
+	if err := json.Unmarshal(payload, &finalize); err != nil {
+		return err
+	}
+	der, err := base64.RawURLEncoding.DecodeString(finalize.CSR)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return err
+	}
+	s.certificate = append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...)
+	return nil
+}
+
+func pathIndex(p string) int {
+	i, _ := strconv.Atoi(path.Base(p))
+	return i
+}
+
+func (s *fakeACMEServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", s.nonce))
+
+	reply := func(status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	fail := func(err error) {
+		s.t.Errorf("fake ACME server: %s", err)
+		reply(http.StatusBadRequest, acmeProblem{Type: "urn:ietf:params:acme:error:malformed", Detail: err.Error()})
+	}
+
+	switch {
+	case r.URL.Path == "/directory":
+		reply(http.StatusOK, acmeDirectory{
+			NewNonce:   s.url("/nonce"),
+			NewAccount: s.url("/account"),
+			NewOrder:   s.url("/order"),
+		})
+		return
+	case r.URL.Path == "/nonce":
+		return
+	}
+
+	payload, err := s.verify(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/account":
+		w.Header().Set("Location", s.url("/account/1"))
+		reply(http.StatusCreated, map[string]string{"status": acmeStatusValid})
+	case r.URL.Path == "/order":
+		var order struct{ Identifiers []acmeIdentifier }
+		if err := json.Unmarshal(payload, &order); err != nil {
+			fail(err)
+			return
+		}
+		s.identifiers = order.Identifiers
+		w.Header().Set("Location", s.url("/order/1"))
+		reply(http.StatusCreated, s.order())
+	case r.URL.Path == "/order/1":
+		reply(http.StatusOK, s.order())
+	case strings.HasPrefix(r.URL.Path, "/authz/"):
+		i := pathIndex(r.URL.Path)
+		status := acmeStatusPending
+		if s.validated[i] {
+			status = acmeStatusValid
+		}
+		reply(http.StatusOK, acmeAuthorization{
+			Status:     status,
+			Identifier: s.identifiers[i],
+			Challenges: []acmeChallenge{
+				{Type: "dns-01", URL: s.url(fmt.Sprintf("/dns/%d", i)), Token: "dns"},
+				{Type: acmeChallengeHTTP01, URL: s.url(fmt.Sprintf("/chall/%d", i)), Token: fmt.Sprintf("token%d", i)},
+			},
+		})
+	case strings.HasPrefix(r.URL.Path, "/chall/"):
+		i := pathIndex(r.URL.Path)
+		if err := s.validate(i); err != nil {
+			fail(err)
+			return
+		}
+		reply(http.StatusOK, map[string]string{"status": acmeStatusProcessing})
+	case r.URL.Path == "/finalize/1":
+		if err := s.issue(payload); err != nil {
+			fail(err)
+			return
+		}
+		reply(http.StatusOK, s.order())
+	case r.URL.Path == "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(s.certificate)
+	default:
+		fail(fmt.Errorf("unexpected request to %s", r.URL.Path))
+	}
+}
+
+func TestACMEManager(t *testing.T) {
+	acmePollInterval = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "kube2lb-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewACMEManager("", dir, "test@example.com", "", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenges := httptest.NewServer(m)
+	defer challenges.Close()
+
+	acmeServer := newFakeACMEServer(t, challenges.URL)
+	defer acmeServer.server.Close()
+	m.client.directoryURL = acmeServer.url("/directory")
+
+	notified := false
+	m.SetNotify(func() { notified = true })
+
+	domains := acmeDomains([]string{"www.example.com", "~^.*\\.example\\.com$", "*.example.com", "example.com"})
+	assert.Equal(t, []string{"example.com", "www.example.com"}, domains)
+
+	info := m.Certificate("test_web", domains)
+	assert.Nil(t, info, "certificate shouldn't be available before obtaining it")
+
+	m.obtainPending(context.Background())
+	assert.True(t, notified, "new certificates should be notified")
+
+	info = m.Certificate("test_web", domains)
+	if assert.NotNil(t, info) {
+		assert.Equal(t, domains, info.SNI)
+		content, err := ioutil.ReadFile(info.CertFile)
+		if assert.NoError(t, err) {
+			assert.True(t, strings.Contains(string(content), "PRIVATE KEY"), "key expected in certificate bundle")
+		}
+	}
+	assert.Equal(t, 0, len(m.pending()), "no certificates should be pending")
+
+	// Certificates are loaded from disk on restart
+	m2, err := NewACMEManager(acmeServer.url("/directory"), dir, "test@example.com", "", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, m.client.jwk(), m2.client.jwk(), "account key should be reused")
+	assert.NotNil(t, m2.Certificate("test_web", domains))
+
+	// Certificates not used are forgotten
+	m2.Sweep()
+	m2.Sweep()
+	assert.Equal(t, 0, len(m2.certificates))
+}
+
+func TestACMETermsOfService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = NewACMEManager("", dir, "test@example.com", "", false, nil)
+	assert.Error(t, err, "terms of service must be accepted")
+
+	m, err := NewACMEManager("", dir, "test@example.com", "", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.client.termsOfServiceAgreed = false
+	m.client.directory = &acmeDirectory{}
+	assert.Error(t, m.client.register(context.Background(), "test@example.com"), "accounts shouldn't be registered without accepting terms of service")
+}
+
+func TestACMERequested(t *testing.T) {
+	cases := []struct {
+		annotation string
+		expected   bool
+	}{
+		{"", false},
+		{"true", true},
+		{"1", true},
+		{"false", false},
+		{"yes", false},
+	}
+
+	c := &KubernetesClient{}
+	for _, tc := range cases {
+		s := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "service1", Namespace: "test"}}
+		if tc.annotation != "" {
+			s.ObjectMeta.Annotations = map[string]string{ACMEAnnotation: tc.annotation}
+		}
+		assert.Equal(t, tc.expected, c.acmeRequested(s), "annotation '%s'", tc.annotation)
+	}
+}
@@ -0,0 +1,470 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	core_v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	acmeChallengePath   = "/.well-known/acme-challenge/"
+	acmeRetryInterval   = time.Hour
+	acmeCheckInterval   = time.Hour
+	acmeObtainTimeout   = 5 * time.Minute
+	acmeSecretPrefix    = "kube2lb-acme."
+	acmeAccountKeyFile  = "account.key"
+	acmeCertificateMode = 0600
+)
+
+var (
+	acmeDirectoryURL     string
+	acmeEmail            string
+	acmeDir              = "/var/lib/kube2lb/acme"
+	acmeHTTPAddress      = "127.0.0.1:8402"
+	acmeCABundle         string
+	acmeRenewBefore      = 30 * 24 * time.Hour
+	acmeSecretsNamespace string
+	acmeAcceptTOS        bool
+)
+
+func init() {
+	flag.StringVar(&acmeDirectoryURL, "acme-directory", "", "URL of the directory of an ACME server to obtain certificates from, ACME is disabled if empty")
+	flag.StringVar(&acmeEmail, "acme-email", "", "Contact email for the ACME account")
+	flag.StringVar(&acmeDir, "acme-dir", acmeDir, "Directory where the ACME account key and certificates are stored")
+	flag.StringVar(&acmeHTTPAddress, "acme-http-address", acmeHTTPAddress, "Address where HTTP-01 challenges are served")
+	flag.StringVar(&acmeCABundle, "acme-ca-bundle", "", "Additional CA certificates to trust when connecting with the ACME server")
+	flag.DurationVar(&acmeRenewBefore, "acme-renew-before", acmeRenewBefore, "Time before expiration to renew certificates")
+	flag.StringVar(&acmeSecretsNamespace, "acme-secrets-namespace", "", "If set, certificates are also stored as secrets in this namespace")
+	flag.BoolVar(&acmeAcceptTOS, "acme-accept-tos", false, "Accept the terms of service of the ACME server, required to register an account")
+}
+
+type acmeCertificate struct {
+	domains  []string
+	info     *TLSInformation
+	notAfter time.Time
+	failedAt time.Time
+	used     bool
+}
+
+func (c *acmeCertificate) needsRenewal() bool {
+	if c.info == nil {
+		return true
+	}
+	return time.Until(c.notAfter) < acmeRenewBefore
+}
+
+// ACMEManager obtains and renews certificates from an ACME server, and
+// serves the HTTP-01 challenges needed to do it
+type ACMEManager struct {
+	sync.Mutex
+
+	client  *acmeClient
+	email   string
+	dir     string
+	secrets core_v1.SecretInterface
+
+	certificates map[string]*acmeCertificate
+	challenges   map[string]string
+
+	wake   chan struct{}
+	notify func()
+}
+
+func NewACMEManager(directoryURL, dir, email, caBundle string, acceptTOS bool, secrets core_v1.SecretInterface) (*ACMEManager, error) {
+	if !acceptTOS {
+		return nil, fmt.Errorf("terms of service of the ACME server must be accepted with -acme-accept-tos")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := loadOrCreateACMEAccountKey(path.Join(dir, acmeAccountKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load ACME account key: %s", err)
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	if caBundle != "" {
+		bundle, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %s", caBundle)
+		}
+		httpClient.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+
+	client := newACMEClient(directoryURL, key, httpClient)
+	client.termsOfServiceAgreed = acceptTOS
+
+	return &ACMEManager{
+		client:       client,
+		email:        email,
+		dir:          dir,
+		secrets:      secrets,
+		certificates: make(map[string]*acmeCertificate),
+		challenges:   make(map[string]string),
+		wake:         make(chan struct{}, 1),
+	}, nil
+}
+
+func loadOrCreateACMEAccountKey(keyFile string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no key found in %s", keyFile)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := writeFileAtomically(keyFile, data, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// acmeDomains returns the server names for which certificates can be
+// obtained with HTTP-01 challenges, regexps and wildcards are not supported
+func acmeDomains(names []string) []string {
+	var domains []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || serverName(name).IsRegexp() || strings.Contains(name, "*") {
+			continue
+		}
+		domains = append(domains, name)
+	}
+	domains = removeDuplicated(domains)
+	sort.Strings(domains)
+	return domains
+}
+
+func (m *ACMEManager) certFile(name string) string {
+	return path.Join(m.dir, name+".pem")
+}
+
+func acmeSecretName(name string) string {
+	return acmeSecretPrefix + strings.Replace(name, "_", ".", -1)
+}
+
+func (m *ACMEManager) tlsInformation(name string, domains []string) *TLSInformation {
+	info := &TLSInformation{
+		CertFile: m.certFile(name),
+		SNI:      domains,
+	}
+	if m.secrets != nil {
+		info.Secret = acmeSecretName(name)
+	}
+	return info
+}
+
+// Certificate returns the information of the current certificate for the
+// given name and domains, or nil if there is no certificate yet. If a new
+// certificate is needed it is requested in background.
+func (m *ACMEManager) Certificate(name string, domains []string) *TLSInformation {
+	if len(domains) == 0 {
+		return nil
+	}
+	sort.Strings(domains)
+
+	m.Lock()
+	defer m.Unlock()
+
+	c, found := m.certificates[name]
+	if !found || !reflect.DeepEqual(c.domains, domains) {
+		c = &acmeCertificate{domains: domains}
+		m.certificates[name] = c
+		m.load(name, c)
+	}
+	c.used = true
+
+	if c.needsRenewal() {
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	}
+	return c.info
+}
+
+// load looks for an stored certificate valid for the domains of c
+func (m *ACMEManager) load(name string, c *acmeCertificate) {
+	data, err := ioutil.ReadFile(m.certFile(name))
+	if os.IsNotExist(err) && m.secrets != nil {
+		data, err = m.loadSecret(name)
+		if err == nil {
+			err = writeFileAtomically(m.certFile(name), data, acmeCertificateMode)
+		}
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Couldn't load certificate for %s: %s", name, err)
+		}
+		return
+	}
+
+	keyPair, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		log.Printf("Invalid stored certificate for %s: %s", name, err)
+		return
+	}
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		log.Printf("Invalid stored certificate for %s: %s", name, err)
+		return
+	}
+	certDomains := append([]string{}, leaf.DNSNames...)
+	sort.Strings(certDomains)
+	if !reflect.DeepEqual(certDomains, c.domains) {
+		return
+	}
+	c.notAfter = leaf.NotAfter
+	c.info = m.tlsInformation(name, c.domains)
+}
+
+func (m *ACMEManager) loadSecret(name string) ([]byte, error) {
+	secret, err := m.secrets.Get(acmeSecretName(name), meta_v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]...), nil
+}
+
+func (m *ACMEManager) storeSecret(name string, chain, key []byte) error {
+	secret := &v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      acmeSecretName(name),
+			Namespace: acmeSecretsNamespace,
+		},
+		Type: v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       chain,
+			v1.TLSPrivateKeyKey: key,
+		},
+	}
+	current, err := m.secrets.Get(secret.Name, meta_v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = m.secrets.Create(secret)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	current.Type = secret.Type
+	current.Data = secret.Data
+	_, err = m.secrets.Update(current)
+	return err
+}
+
+// Sweep forgets about the certificates that haven't been requested since the
+// last sweep, so they are not renewed anymore
+func (m *ACMEManager) Sweep() {
+	m.Lock()
+	defer m.Unlock()
+
+	for name, c := range m.certificates {
+		if !c.used {
+			delete(m.certificates, name)
+			continue
+		}
+		c.used = false
+	}
+}
+
+// ServeHTTP serves the key authorizations of pending HTTP-01 challenges
+func (m *ACMEManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		http.NotFound(w, r)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+
+	m.Lock()
+	keyAuthorization, found := m.challenges[token]
+	m.Unlock()
+
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuthorization))
+}
+
+func (m *ACMEManager) solve(token, keyAuthorization string) {
+	m.Lock()
+	m.challenges[token] = keyAuthorization
+	m.Unlock()
+}
+
+// pending returns the certificates that need to be obtained or renewed
+func (m *ACMEManager) pending() map[string][]string {
+	m.Lock()
+	defer m.Unlock()
+
+	pending := make(map[string][]string)
+	for name, c := range m.certificates {
+		if c.needsRenewal() && time.Since(c.failedAt) > acmeRetryInterval {
+			pending[name] = c.domains
+		}
+	}
+	return pending
+}
+
+func (m *ACMEManager) obtain(ctx context.Context, name string, domains []string) error {
+	ctx, cancel := context.WithTimeout(ctx, acmeObtainTimeout)
+	defer cancel()
+
+	if err := m.client.register(ctx, m.email); err != nil {
+		return err
+	}
+	chain, key, err := m.client.obtain(ctx, domains, m.solve)
+	if err != nil {
+		return err
+	}
+
+	keyPair, err := tls.X509KeyPair(chain, key)
+	if err != nil {
+		return fmt.Errorf("invalid certificate received: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("invalid certificate received: %s", err)
+	}
+
+	bundle := append(append([]byte{}, chain...), key...)
+	if err := writeFileAtomically(m.certFile(name), bundle, acmeCertificateMode); err != nil {
+		return err
+	}
+	if m.secrets != nil {
+		if err := m.storeSecret(name, chain, key); err != nil {
+			log.Printf("Couldn't store certificate for %s in secret: %s", name, err)
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if c, found := m.certificates[name]; found && reflect.DeepEqual(c.domains, domains) {
+		c.notAfter = leaf.NotAfter
+		c.info = m.tlsInformation(name, domains)
+	}
+	return nil
+}
+
+func (m *ACMEManager) obtainPending(ctx context.Context) {
+	changed := false
+	for name, domains := range m.pending() {
+		log.Printf("Obtaining certificate for %s from ACME server", strings.Join(domains, ", "))
+		if err := m.obtain(ctx, name, domains); err != nil {
+			log.Printf("Couldn't obtain certificate for %s: %s", strings.Join(domains, ", "), err)
+			m.Lock()
+			if c, found := m.certificates[name]; found {
+				c.failedAt = time.Now()
+			}
+			m.Unlock()
+			continue
+		}
+		changed = true
+	}
+
+	m.Lock()
+	m.challenges = make(map[string]string)
+	notify := m.notify
+	m.Unlock()
+
+	if changed && notify != nil {
+		notify()
+	}
+}
+
+// SetNotify sets the function called when new certificates are available
+func (m *ACMEManager) SetNotify(notify func()) {
+	m.Lock()
+	defer m.Unlock()
+	m.notify = notify
+}
+
+// Run serves HTTP-01 challenges and obtains certificates when needed
+func (m *ACMEManager) Run(ctx context.Context, address string) {
+	server := &http.Server{Addr: address, Handler: m}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Couldn't serve ACME challenges: %s", err)
+		}
+	}()
+
+	ticker := time.NewTicker(acmeCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			server.Close()
+			return
+		case <-m.wake:
+		case <-ticker.C:
+		}
+		m.obtainPending(ctx)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Default timeout for client IP affinity used by kubernetes, the version of
+// the API used by kube2lb doesn't allow to configure it per service
+const defaultSessionAffinityTimeout = 10800
+
+type SessionAffinityInformation struct {
+	// ClientIP is true if requests from the same client IP must be sent
+	// to the same endpoint
+	ClientIP bool
+
+	// Timeout in seconds for client IP affinity
+	Timeout int
+
+	// Cookie is the name of the cookie used for stickiness on HTTP ports,
+	// empty if cookies are not used
+	Cookie string
+}
+
+// validateCookieName checks that a name can be used as a cookie name, as
+// defined in RFC 6265
+func validateCookieName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty cookie name")
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", c) {
+			return fmt.Errorf("invalid character %q in cookie name %q", c, name)
+		}
+	}
+	return nil
+}
+
+// sessionAffinity returns the session affinity settings for a port of a
+// service, or nil if no affinity is needed
+func (c *KubernetesClient) sessionAffinity(s *v1.Service, port, mode string, cookies map[string]string) *SessionAffinityInformation {
+	var affinity SessionAffinityInformation
+	if s.Spec.SessionAffinity == v1.ServiceAffinityClientIP {
+		affinity.ClientIP = true
+		affinity.Timeout = defaultSessionAffinityTimeout
+	}
+
+	if cookie, ok := cookies[port]; ok {
+		switch err := validateCookieName(cookie); {
+		case err != nil:
+			c.serviceWarningf(s, "InvalidAnnotation", "Ignoring invalid %s annotation for port %s of %s in %s: %s", StickyCookieAnnotation, port, s.Name, s.Namespace, err)
+		case mode != "http":
+			c.serviceWarningf(s, "InvalidAnnotation", "Ignoring %s annotation for port %s of %s in %s: cookies can only be used in http mode", StickyCookieAnnotation, port, s.Name, s.Namespace)
+		default:
+			affinity.Cookie = cookie
+		}
+	}
+
+	if !affinity.ClientIP && affinity.Cookie == "" {
+		return nil
+	}
+	return &affinity
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestSessionAffinity(t *testing.T) {
+	cookies := map[string]string{
+		"http":    "SERVERID",
+		"tcp":     "SERVERID",
+		"invalid": "SERVER ID",
+	}
+
+	cases := []struct {
+		title    string
+		affinity v1.ServiceAffinity
+		port     string
+		mode     string
+		expected *SessionAffinityInformation
+	}{
+		{"No affinity", v1.ServiceAffinityNone, "other", "http", nil},
+		{"Client IP", v1.ServiceAffinityClientIP, "other", "tcp", &SessionAffinityInformation{ClientIP: true, Timeout: defaultSessionAffinityTimeout}},
+		{"Cookie", v1.ServiceAffinityNone, "http", "http", &SessionAffinityInformation{Cookie: "SERVERID"}},
+		{"Client IP and cookie", v1.ServiceAffinityClientIP, "http", "http", &SessionAffinityInformation{ClientIP: true, Timeout: defaultSessionAffinityTimeout, Cookie: "SERVERID"}},
+		{"Cookie in tcp mode", v1.ServiceAffinityNone, "tcp", "tcp", nil},
+		{"Invalid cookie", v1.ServiceAffinityNone, "invalid", "http", nil},
+	}
+
+	client := &KubernetesClient{}
+	for _, c := range cases {
+		s := &v1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "test", Namespace: "default"},
+			Spec:       v1.ServiceSpec{SessionAffinity: c.affinity},
+		}
+		assert.Equal(t, c.expected, client.sessionAffinity(s, c.port, c.mode, cookies), c.title)
+	}
+}
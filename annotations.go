@@ -0,0 +1,82 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const AnnotationsPrefix = "kube2lb/"
+
+var exposeLabels = false
+
+func init() {
+	flag.BoolVar(&exposeLabels, "expose-labels", exposeLabels, "Pass the labels of services to templates")
+}
+
+// serviceAnnotations returns the kube2lb annotations of an object, without
+// the prefix
+func serviceAnnotations(meta meta_v1.ObjectMeta) map[string]string {
+	annotations := make(map[string]string)
+	for key, value := range meta.Annotations {
+		if strings.HasPrefix(key, AnnotationsPrefix) {
+			annotations[strings.TrimPrefix(key, AnnotationsPrefix)] = value
+		}
+	}
+	return annotations
+}
+
+// serviceLabels returns the labels of an object if they are exposed
+func serviceLabels(meta meta_v1.ObjectMeta) map[string]string {
+	if !exposeLabels {
+		return nil
+	}
+	labels := make(map[string]string, len(meta.Labels))
+	for key, value := range meta.Labels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// parseJSON is intended to be used in templates to parse JSON values
+func parseJSON(data string) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// portAnnotation is intended to be used in templates to read the value of a
+// per-port annotation, declared as a JSON map with the port names as keys.
+// It returns nil if the annotation doesn't contain a value for the port.
+func portAnnotation(s ServiceInformation, annotation string) (interface{}, error) {
+	data, found := s.Annotations[strings.TrimPrefix(annotation, AnnotationsPrefix)]
+	if !found || len(data) == 0 {
+		return nil, nil
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &values); err != nil {
+		return nil, fmt.Errorf("couldn't parse %s annotation for %s service: %s", annotation, s.Name, err)
+	}
+	return values[s.PortName], nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServiceAnnotations(t *testing.T) {
+	meta := meta_v1.ObjectMeta{
+		Annotations: map[string]string{
+			"kube2lb/balance":       "leastconn",
+			"kube2lb/health-check":  `{"http": "/healthz"}`,
+			"other.io/balance":      "roundrobin",
+			"kube2lbnotprefix/test": "foo",
+		},
+		Labels: map[string]string{"app": "test"},
+	}
+	assert.Equal(t, map[string]string{
+		"balance":      "leastconn",
+		"health-check": `{"http": "/healthz"}`,
+	}, serviceAnnotations(meta))
+
+	assert.Nil(t, serviceLabels(meta))
+	exposeLabels = true
+	defer func() { exposeLabels = false }()
+	assert.Equal(t, map[string]string{"app": "test"}, serviceLabels(meta))
+}
+
+func TestPortAnnotation(t *testing.T) {
+	service := ServiceInformation{
+		Name:     "test",
+		PortName: "http",
+		Annotations: map[string]string{
+			"health-check": `{"http": "/healthz", "admin": "/status"}`,
+			"maxconn":      `{"http": 100}`,
+			"invalid":      `{"http"`,
+		},
+	}
+
+	cases := []struct {
+		annotation string
+		expected   interface{}
+		err        bool
+	}{
+		{"health-check", "/healthz", false},
+		{"kube2lb/health-check", "/healthz", false},
+		{"maxconn", float64(100), false},
+		{"missing", nil, false},
+		{"invalid", nil, true},
+	}
+
+	for _, c := range cases {
+		value, err := portAnnotation(service, c.annotation)
+		if c.err {
+			assert.Error(t, err, c.annotation)
+			continue
+		}
+		assert.NoError(t, err, c.annotation)
+		assert.Equal(t, c.expected, value, c.annotation)
+	}
+
+	value, err := portAnnotation(ServiceInformation{PortName: "other", Annotations: service.Annotations}, "maxconn")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+}
+
+func TestParseJSON(t *testing.T) {
+	value, err := parseJSON(`{"a": [1, 2]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": []interface{}{float64(1), float64(2)}}, value)
+
+	_, err = parseJSON(`{`)
+	assert.Error(t, err)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Balancing algorithms that can be requested with the balance annotation,
+// templates are responsible of translating them to the load balancer syntax
+var balanceAlgorithms = map[string]bool{
+	"roundrobin": true,
+	"leastconn":  true,
+	"source":     true,
+	"uri":        true,
+	"random":     true,
+	"first":      true,
+}
+
+// HealthCheck defines how endpoints of a service are checked
+type HealthCheck struct {
+	// Path requested on HTTP checks, if empty, only connectivity is checked
+	Path string `json:"path"`
+
+	// Interval between checks in milliseconds, zero to use the template default
+	Interval int `json:"interval"`
+
+	// ExpectedStatus is the HTTP status expected on healthy endpoints, zero
+	// to accept any status considered healthy by the load balancer
+	ExpectedStatus int `json:"expected-status"`
+}
+
+func (h *HealthCheck) Validate() error {
+	if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+		return fmt.Errorf("path %q must start with /", h.Path)
+	}
+	if strings.ContainsAny(h.Path, " \t\r\n") {
+		return fmt.Errorf("path %q cannot contain spaces", h.Path)
+	}
+	if h.Interval < 0 {
+		return fmt.Errorf("interval must be positive, found %d", h.Interval)
+	}
+	if h.ExpectedStatus != 0 && (h.ExpectedStatus < 100 || h.ExpectedStatus > 599) {
+		return fmt.Errorf("invalid expected status %d", h.ExpectedStatus)
+	}
+	return nil
+}
+
+func validateBalance(balance string) error {
+	if !balanceAlgorithms[balance] {
+		return fmt.Errorf("unknown balancing algorithm %q", balance)
+	}
+	return nil
+}
+
+func validateMaxConnections(maxConnections int) error {
+	if maxConnections <= 0 {
+		return fmt.Errorf("maximum number of connections must be positive, found %d", maxConnections)
+	}
+	return nil
+}
+
+// BalancingAnnotations contains the per-port balancing options declared in
+// the annotations of a service
+type BalancingAnnotations struct {
+	Balance        map[string]string
+	MaxConnections map[string]int
+	HealthCheck    map[string]*HealthCheck
+
+	client *KubernetesClient
+}
+
+func (c *KubernetesClient) readBalancingAnnotations(s *v1.Service) *BalancingAnnotations {
+	a := BalancingAnnotations{client: c}
+	c.readAnnotation(s, BalanceAnnotation, &a.Balance)
+	c.readAnnotation(s, MaxConnectionsAnnotation, &a.MaxConnections)
+	c.readAnnotation(s, HealthCheckAnnotation, &a.HealthCheck)
+	return &a
+}
+
+// PortBalancing returns the validated balancing options for a port, invalid
+// options are logged and ignored
+func (a *BalancingAnnotations) PortBalancing(s *v1.Service, port string) (balance string, maxConnections int, healthCheck *HealthCheck) {
+	invalid := func(annotation string, err error) {
+		a.client.serviceWarningf(s, "InvalidAnnotation", "Ignoring invalid %s annotation for port %s of %s in %s: %s", annotation, port, s.Name, s.Namespace, err)
+	}
+
+	if value, ok := a.Balance[port]; ok {
+		value = strings.ToLower(value)
+		if err := validateBalance(value); err != nil {
+			invalid(BalanceAnnotation, err)
+		} else {
+			balance = value
+		}
+	}
+
+	if value, ok := a.MaxConnections[port]; ok {
+		if err := validateMaxConnections(value); err != nil {
+			invalid(MaxConnectionsAnnotation, err)
+		} else {
+			maxConnections = value
+		}
+	}
+
+	if value, ok := a.HealthCheck[port]; ok && value != nil {
+		if err := value.Validate(); err != nil {
+			invalid(HealthCheckAnnotation, err)
+		} else {
+			healthCheck = value
+		}
+	}
+
+	return
+}
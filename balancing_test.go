@@ -0,0 +1,81 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestPortBalancing(t *testing.T) {
+	c := &KubernetesClient{}
+	s := &v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      "test",
+			Namespace: "default",
+			Annotations: map[string]string{
+				BalanceAnnotation:        `{"http": "RoundRobin", "admin": "fastest", "other": "source"}`,
+				MaxConnectionsAnnotation: `{"http": 100, "admin": -1}`,
+				HealthCheckAnnotation: `{
+					"http": {"path": "/healthz", "interval": 2000, "expected-status": 200},
+					"admin": {"path": "healthz"},
+					"other": {"expected-status": 1000},
+					"tcp": {"interval": 1000}
+				}`,
+			},
+		},
+	}
+
+	cases := []struct {
+		port           string
+		balance        string
+		maxConnections int
+		healthCheck    *HealthCheck
+	}{
+		{"http", "roundrobin", 100, &HealthCheck{Path: "/healthz", Interval: 2000, ExpectedStatus: 200}},
+		{"admin", "", 0, nil},
+		{"other", "source", 0, nil},
+		{"tcp", "", 0, &HealthCheck{Interval: 1000}},
+		{"unknown", "", 0, nil},
+	}
+
+	balancing := c.readBalancingAnnotations(s)
+	for _, tc := range cases {
+		balance, maxConnections, healthCheck := balancing.PortBalancing(s, tc.port)
+		assert.Equal(t, tc.balance, balance, tc.port)
+		assert.Equal(t, tc.maxConnections, maxConnections, tc.port)
+		assert.Equal(t, tc.healthCheck, healthCheck, tc.port)
+	}
+}
+
+func TestPortBalancingInvalidJSON(t *testing.T) {
+	c := &KubernetesClient{}
+	s := &v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name: "test",
+			Annotations: map[string]string{
+				MaxConnectionsAnnotation: `{"http": "many"}`,
+			},
+		},
+	}
+
+	_, maxConnections, _ := c.readBalancingAnnotations(s).PortBalancing(s, "http")
+	assert.Equal(t, 0, maxConnections)
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var tlsDir string
+
+func init() {
+	flag.StringVar(&tlsDir, "tls-dir", "", "Directory where certificates from TLS secrets are written, secrets are not watched if empty")
+}
+
+type TLSInformation struct {
+	Secret   string
+	CertFile string
+	SNI      []string
+}
+
+// CertificatesWriter writes bundles of certificates and keys from TLS
+// secrets to files that can be used by load balancers
+type CertificatesWriter struct {
+	sync.Mutex
+
+	dir     string
+	written map[string]bool
+	used    map[string]bool
+}
+
+func NewCertificatesWriter(dir string) (*CertificatesWriter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &CertificatesWriter{
+		dir:     dir,
+		written: make(map[string]bool),
+		used:    make(map[string]bool),
+	}, nil
+}
+
+// Write writes the certificate and key of a TLS secret to a file in the
+// certificates directory, if the file already has the same content it is
+// not modified
+func (w *CertificatesWriter) Write(secret *v1.Secret) (*TLSInformation, error) {
+	if secret.Type != v1.SecretTypeTLS {
+		return nil, fmt.Errorf("secret %s in %s is not of type %s", secret.Name, secret.Namespace, v1.SecretTypeTLS)
+	}
+
+	cert := secret.Data[v1.TLSCertKey]
+	key := secret.Data[v1.TLSPrivateKeyKey]
+	keyPair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate in secret %s in %s: %s", secret.Name, secret.Namespace, err)
+	}
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate in secret %s in %s: %s", secret.Name, secret.Namespace, err)
+	}
+
+	sni := leaf.DNSNames
+	if len(sni) == 0 && leaf.Subject.CommonName != "" {
+		sni = []string{leaf.Subject.CommonName}
+	}
+
+	var bundle bytes.Buffer
+	bundle.Write(bytes.TrimSpace(cert))
+	bundle.WriteString("\n")
+	bundle.Write(bytes.TrimSpace(key))
+	bundle.WriteString("\n")
+
+	certFile := path.Join(w.dir, fmt.Sprintf("%s_%s.pem", secret.Namespace, secret.Name))
+	if err := writeFileAtomically(certFile, bundle.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+
+	w.Lock()
+	w.written[certFile] = true
+	w.used[certFile] = true
+	w.Unlock()
+
+	return &TLSInformation{
+		Secret:   secret.Name,
+		CertFile: certFile,
+		SNI:      sni,
+	}, nil
+}
+
+// Cleanup removes the files written by previous updates that haven't been
+// written since the last cleanup
+func (w *CertificatesWriter) Cleanup() {
+	w.Lock()
+	defer w.Unlock()
+
+	for certFile := range w.written {
+		if w.used[certFile] {
+			continue
+		}
+		if err := os.Remove(certFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("Couldn't remove unused certificate %s: %s", certFile, err)
+			continue
+		}
+		delete(w.written, certFile)
+	}
+	w.used = make(map[string]bool)
+}
+
+// writeFileAtomically writes data to a temporary file that replaces the
+// destination once completely written. Nothing is done if the destination
+// already has the same content.
+func writeFileAtomically(filename string, data []byte, perm os.FileMode) error {
+	if current, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(path.Dir(filename), "."+path.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// portCertificates returns the certificate files of the services using a port
+func portCertificates(services []ServiceInformation, port PortSpec) []string {
+	seen := make(map[string]bool)
+	var certFiles []string
+	for _, service := range services {
+		if service.TLS == nil || service.Port.String() != port.String() || seen[service.TLS.CertFile] {
+			continue
+		}
+		seen[service.TLS.CertFile] = true
+		certFiles = append(certFiles, service.TLS.CertFile)
+	}
+	sort.Strings(certFiles)
+	return certFiles
+}
+
+// ingressCertificates returns the certificate files used by a list of ingresses
+func ingressCertificates(ingresses []IngressInformation) []string {
+	seen := make(map[string]bool)
+	var certFiles []string
+	for _, ingress := range ingresses {
+		for _, tls := range ingress.TLS {
+			if tls.CertFile == "" || seen[tls.CertFile] {
+				continue
+			}
+			seen[tls.CertFile] = true
+			certFiles = append(certFiles, tls.CertFile)
+		}
+	}
+	sort.Strings(certFiles)
+	return certFiles
+}
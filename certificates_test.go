@@ -0,0 +1,125 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func generateTestCertificate(t *testing.T, names ...string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return
+}
+
+func TestCertificatesWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-certificates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewCertificatesWriter(path.Join(dir, "certs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, key := generateTestCertificate(t, "test.example.com", "www.example.com")
+	secret := &v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "test-tls", Namespace: "test"},
+		Type:       v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       cert,
+			v1.TLSPrivateKeyKey: key,
+		},
+	}
+
+	info, err := w.Write(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "test-tls", info.Secret)
+	assert.Equal(t, []string{"test.example.com", "www.example.com"}, info.SNI)
+	assert.Equal(t, path.Join(dir, "certs", "test_test-tls.pem"), info.CertFile)
+
+	stat, err := os.Stat(info.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm(), "certificates should only be readable by owner")
+
+	content, err := ioutil.ReadFile(info.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(cert)+string(key), string(content))
+
+	files, _ := ioutil.ReadDir(path.Join(dir, "certs"))
+	assert.Equal(t, 1, len(files), "no temporary files should be left")
+
+	w.Cleanup()
+	_, err = os.Stat(info.CertFile)
+	assert.NoError(t, err, "used certificates shouldn't be removed")
+
+	w.Cleanup()
+	_, err = os.Stat(info.CertFile)
+	assert.True(t, os.IsNotExist(err), "unused certificates should be removed")
+
+	secret.Type = v1.SecretTypeOpaque
+	_, err = w.Write(secret)
+	assert.Error(t, err, "only TLS secrets should be accepted")
+
+	secret.Type = v1.SecretTypeTLS
+	secret.Data[v1.TLSPrivateKeyKey] = []byte("foo")
+	_, err = w.Write(secret)
+	assert.Error(t, err, "invalid keys should be detected")
+}
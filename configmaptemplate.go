@@ -0,0 +1,137 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// configMapTemplatePrefix is used in template sources to read templates
+// from config maps
+const configMapTemplatePrefix = "configmap:"
+
+// configMapTemplateFuncs contains the functions available to templates read
+// from config maps. Anyone allowed to update the config map can write these
+// templates, so functions exposing the environment of the process are not
+// included
+var configMapTemplateFuncs = func() template.FuncMap {
+	funcs := make(template.FuncMap)
+	for name, f := range templateFuncs {
+		if name == "Env" {
+			continue
+		}
+		funcs[name] = f
+	}
+	return funcs
+}()
+
+// ConfigMapKey identifies a key in a config map
+type ConfigMapKey struct {
+	Namespace, Name, Key string
+}
+
+func (k ConfigMapKey) String() string {
+	return fmt.Sprintf("%s%s/%s/%s", configMapTemplatePrefix, k.Namespace, k.Name, k.Key)
+}
+
+// parseConfigMapTemplateSource parses template sources in the form
+// configmap:NAMESPACE/NAME/KEY, it returns nil if the source is not a
+// config map
+func parseConfigMapTemplateSource(source string) (*ConfigMapKey, error) {
+	if !strings.HasPrefix(source, configMapTemplatePrefix) {
+		return nil, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(source, configMapTemplatePrefix), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("config map template source must be in the form %sNAMESPACE/NAME/KEY: %s", configMapTemplatePrefix, source)
+	}
+	return &ConfigMapKey{Namespace: parts[0], Name: parts[1], Key: parts[2]}, nil
+}
+
+// configMapTemplate is a template whose source is a config map, all keys
+// in the config map are parsed as templates named as the keys, so they can
+// be used from the entry template
+type configMapTemplate struct {
+	Source ConfigMapKey
+	Path   string
+
+	getConfigMap func(namespace, name string) (*v1.ConfigMap, error)
+	warnf        func(cm *v1.ConfigMap, reason, format string, args ...interface{})
+
+	cache templateCache
+}
+
+// load returns the parsed template, it is only parsed again if the config
+// map changes
+func (t *configMapTemplate) load() (*template.Template, error) {
+	cm, err := t.getConfigMap(t.Source.Namespace, t.Source.Name)
+	if err == nil && cm == nil {
+		err = fmt.Errorf("config map %s/%s not found", t.Source.Namespace, t.Source.Name)
+	}
+	var version string
+	if err == nil {
+		version = cm.ResourceVersion
+	}
+	s, _, err := t.cache.get(t.Source.String(), version, err, func() (*template.Template, error) {
+		s, err := parseConfigMapTemplate(cm, t.Source.Key)
+		if err != nil && t.warnf != nil {
+			t.warnf(cm, "InvalidTemplate", "Couldn't parse template in %s: %s", t.Source, err)
+		}
+		return s, err
+	})
+	return s, err
+}
+
+// parseConfigMapTemplate parses all keys of a config map, the template
+// named as entry is the one executed
+func parseConfigMapTemplate(cm *v1.ConfigMap, entry string) (*template.Template, error) {
+	if _, found := cm.Data[entry]; !found {
+		return nil, fmt.Errorf("key %s not found in config map %s/%s", entry, cm.Namespace, cm.Name)
+	}
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	s := template.New(entry).Funcs(configMapTemplateFuncs)
+	for _, key := range keys {
+		var tmpl *template.Template
+		if key == entry {
+			tmpl = s
+		} else {
+			tmpl = s.New(key)
+		}
+		if _, err := tmpl.Parse(cm.Data[key]); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (t *configMapTemplate) Execute(info *ClusterInformation) error {
+	s, err := t.load()
+	if err != nil {
+		return err
+	}
+	return writeConfig(s, t.Path, info)
+}
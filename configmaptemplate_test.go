@@ -0,0 +1,143 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestParseConfigMapTemplateSource(t *testing.T) {
+	cases := []struct {
+		source   string
+		expected *ConfigMapKey
+		valid    bool
+	}{
+		{"/etc/kube2lb/haproxy.cfg.tpl", nil, true},
+		{"configmap:kube-system/templates/haproxy.cfg.tpl", &ConfigMapKey{"kube-system", "templates", "haproxy.cfg.tpl"}, true},
+		{"configmap:kube-system/templates", nil, false},
+		{"configmap:kube-system/templates/", nil, false},
+		{"configmap:/templates/haproxy.cfg.tpl", nil, false},
+		{"configmap:kube-system/templates/haproxy/cfg", nil, false},
+	}
+	for _, c := range cases {
+		key, err := parseConfigMapTemplateSource(c.source)
+		if !c.valid {
+			assert.Error(t, err, c.source)
+			continue
+		}
+		if assert.NoError(t, err, c.source) {
+			assert.Equal(t, c.expected, key, c.source)
+		}
+		if key != nil {
+			assert.Equal(t, c.source, key.String())
+		}
+	}
+}
+
+func TestConfigMapTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var cm *v1.ConfigMap
+	setConfigMap := func(version int, data map[string]string) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Namespace:       "kube-system",
+				Name:            "templates",
+				ResourceVersion: fmt.Sprint(version),
+			},
+			Data: data,
+		}
+	}
+	var warnings []string
+	configPath := filepath.Join(dir, "config")
+	tpl := &configMapTemplate{
+		Source: ConfigMapKey{"kube-system", "templates", "main.tpl"},
+		Path:   configPath,
+		getConfigMap: func(namespace, name string) (*v1.ConfigMap, error) {
+			if cm == nil || namespace != cm.Namespace || name != cm.Name {
+				return nil, nil
+			}
+			return cm, nil
+		},
+		warnf: func(cm *v1.ConfigMap, reason, format string, args ...interface{}) {
+			warnings = append(warnings, reason)
+		},
+	}
+	info := &ClusterInformation{
+		Domain:   "cluster.local",
+		Services: []ServiceInformation{{Name: "a"}, {Name: "b"}},
+	}
+	assertConfig := func(expected string) {
+		if err := tpl.Execute(info); err != nil {
+			t.Fatal(err)
+		}
+		config, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, string(config))
+	}
+
+	assert.Error(t, tpl.Execute(info), "config map doesn't exist")
+
+	setConfigMap(1, map[string]string{"other.tpl": ""})
+	assert.Error(t, tpl.Execute(info), "key doesn't exist")
+	assert.Equal(t, []string{"InvalidTemplate"}, warnings)
+	warnings = nil
+
+	setConfigMap(2, map[string]string{
+		"main.tpl":     `domain {{ .Domain }}{{ "\n" }}{{ range .Services }}{{ template "backends.tpl" . }}{{ end }}`,
+		"backends.tpl": `backend {{ .Name }}{{ "\n" }}`,
+	})
+	assertConfig("domain cluster.local\nbackend a\nbackend b\n")
+
+	setConfigMap(3, map[string]string{
+		"main.tpl":     `domain {{ .Domain }}{{ "\n" }}{{ range .Services }}{{ template "backends.tpl" . }}{{ end }}`,
+		"backends.tpl": `server {{ .Name `,
+	})
+	assertConfig("domain cluster.local\nbackend a\nbackend b\n")
+	assert.Equal(t, []string{"InvalidTemplate"}, warnings)
+
+	// Invalid versions are only reported once
+	assertConfig("domain cluster.local\nbackend a\nbackend b\n")
+	assert.Equal(t, []string{"InvalidTemplate"}, warnings)
+
+	cm = nil
+	assertConfig("domain cluster.local\nbackend a\nbackend b\n")
+
+	setConfigMap(4, map[string]string{
+		"main.tpl":     `domain {{ .Domain }}{{ "\n" }}{{ range .Services }}{{ template "backends.tpl" . }}{{ end }}`,
+		"backends.tpl": `server {{ .Name }}{{ "\n" }}`,
+	})
+	assertConfig("domain cluster.local\nserver a\nserver b\n")
+
+	setConfigMap(5, map[string]string{"main.tpl": `{{ Env "KUBE2LB_DOMAIN" }}`})
+	assertConfig("domain cluster.local\nserver a\nserver b\n")
+	assert.Equal(t, []string{"InvalidTemplate", "InvalidTemplate"}, warnings, "Env shouldn't be available in config maps")
+}
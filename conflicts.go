@@ -0,0 +1,256 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	ConflictServerName = "server-name"
+	ConflictPath       = "path"
+	ConflictPort       = "port"
+)
+
+// Conflict describes a resource claimed by a service that was already in use
+// by another one
+type Conflict struct {
+	Kind    string
+	Service ServiceInformation
+	Owner   ServiceInformation
+	Message string
+}
+
+func (s ServiceInformation) sameService(o ServiceInformation) bool {
+	return s.Name == o.Name && s.Namespace == o.Namespace
+}
+
+// created returns the creation time of the service, zero if unknown
+func (s ServiceInformation) created() meta_v1.Time {
+	if s.source == nil {
+		return meta_v1.Time{}
+	}
+	return s.source.CreationTimestamp
+}
+
+// olderThan decides which service wins a conflict, older services go first,
+// services created at the same time are sorted by namespace and name
+func (s ServiceInformation) olderThan(o ServiceInformation) bool {
+	if created, otherCreated := s.created(), o.created(); !created.Equal(otherCreated) {
+		return created.Before(otherCreated)
+	}
+	if s.Namespace != o.Namespace {
+		return s.Namespace < o.Namespace
+	}
+	return s.Name < o.Name
+}
+
+type conflictsResolver struct {
+	domain    string
+	claims    map[string]ServiceInformation
+	conflicts []Conflict
+}
+
+// claim tries to claim a resource for a service, it returns false and
+// records the conflict if the resource is already owned by other service
+func (r *conflictsResolver) claim(kind, key string, service ServiceInformation, format string, args ...interface{}) bool {
+	key = kind + " " + key
+	owner, found := r.claims[key]
+	if found && !owner.sameService(service) {
+		message := fmt.Sprintf(format, args...)
+		r.conflicts = append(r.conflicts, Conflict{
+			Kind:    kind,
+			Service: service,
+			Owner:   owner,
+			Message: fmt.Sprintf("%s of %s in %s is already used by %s in %s", message, service.Name, service.Namespace, owner.Name, owner.Namespace),
+		})
+		return false
+	}
+	return true
+}
+
+func (r *conflictsResolver) own(kind, key string, service ServiceInformation) {
+	r.claims[kind+" "+key] = service
+}
+
+// resolveConflicts looks for services claiming the same port, or the same
+// server name or path in the same port. The oldest service keeps the claimed
+// resource, newer services lose conflicting external domains and paths, or
+// are removed if it's not possible to solve the conflict otherwise.
+func resolveConflicts(services []ServiceInformation, domain string) ([]ServiceInformation, []Conflict) {
+	sorted := make([]ServiceInformation, len(services))
+	copy(sorted, services)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].olderThan(sorted[j])
+	})
+
+	r := &conflictsResolver{
+		domain: domain,
+		claims: make(map[string]ServiceInformation),
+	}
+	resolved := make([]ServiceInformation, 0, len(sorted))
+	for _, service := range sorted {
+		var ok bool
+		switch {
+		case service.Port.Mode != "http":
+			ok = r.resolvePort(&service)
+		case !r.resolveHTTPPort(&service):
+			ok = false
+		case len(service.Paths) == 0:
+			ok = r.resolveServerNames(&service)
+		default:
+			ok = r.resolvePaths(&service)
+		}
+		if ok {
+			resolved = append(resolved, service)
+		}
+	}
+	return resolved, r.conflicts
+}
+
+// portKeys returns the keys of the addresses used by a port, one for each of
+// its IPs. Mode is not included, as services in different modes cannot share
+// an address.
+func portKeys(port PortSpec) []string {
+	ips := port.IPs
+	if len(ips) == 0 {
+		ips = []net.IP{port.IP}
+	}
+	keys := make([]string, len(ips))
+	for i, ip := range ips {
+		keys[i] = fmt.Sprintf("%s %s", joinHostPort(ip, port.Port), port.Protocol)
+	}
+	return keys
+}
+
+// httpPortKey is the key of an address claimed by http services, that can
+// be shared between them as requests are routed by server name
+func httpPortKey(key string) string {
+	return key + " http"
+}
+
+// resolvePort solves conflicts between services using the same port in modes
+// where requests cannot be routed by server name, these ports cannot be
+// shared with any other service
+func (r *conflictsResolver) resolvePort(service *ServiceInformation) bool {
+	keys := portKeys(service.Port)
+	for _, key := range keys {
+		if !r.claim(ConflictPort, key, *service, "Port %d", service.Port.Port) ||
+			!r.claim(ConflictPort, httpPortKey(key), *service, "Port %d", service.Port.Port) {
+			return false
+		}
+	}
+	for _, key := range keys {
+		r.own(ConflictPort, key, *service)
+	}
+	return true
+}
+
+// resolveHTTPPort solves conflicts between http services and services using
+// the same port in other modes, http services can share ports between them
+func (r *conflictsResolver) resolveHTTPPort(service *ServiceInformation) bool {
+	keys := portKeys(service.Port)
+	for _, key := range keys {
+		if !r.claim(ConflictPort, key, *service, "Port %d", service.Port.Port) {
+			return false
+		}
+	}
+	for _, key := range keys {
+		// The oldest service is kept as owner to report conflicts
+		if _, found := r.claims[ConflictPort+" "+httpPortKey(key)]; !found {
+			r.own(ConflictPort, httpPortKey(key), *service)
+		}
+	}
+	return true
+}
+
+// resolveServerNames solves conflicts between services without paths using
+// the same server names, conflicting external domains are removed, services
+// are removed if the conflicting name is not an external domain
+func (r *conflictsResolver) resolveServerNames(service *ServiceInformation) bool {
+	generated := *service
+	generated.External = nil
+	for _, name := range generateServerNames(generated, r.domain) {
+		key := fmt.Sprintf("%s %s", service.Port, name)
+		if !r.claim(ConflictServerName, key, *service, "Server name %s in port %d", name, service.Port.Port) {
+			return false
+		}
+	}
+
+	var external []string
+	for _, name := range service.External {
+		key := fmt.Sprintf("%s %s", service.Port, name)
+		if r.claim(ConflictServerName, key, *service, "External domain %s in port %d", name, service.Port.Port) {
+			external = append(external, name)
+		}
+	}
+	service.External = external
+
+	for _, name := range generateServerNames(*service, r.domain) {
+		r.own(ConflictServerName, fmt.Sprintf("%s %s", service.Port, name), *service)
+	}
+	return true
+}
+
+// resolvePaths solves conflicts between services claiming the same path for
+// the same server name, conflicting paths are removed, and services without
+// paths are removed
+func (r *conflictsResolver) resolvePaths(service *ServiceInformation) bool {
+	serverNames := generateServerNames(*service, r.domain)
+	var paths []PathRule
+	for _, path := range service.Paths {
+		conflict := false
+		for _, serverName := range serverNames {
+			key := fmt.Sprintf("%s %s %s", service.Port, serverName, path)
+			if !r.claim(ConflictPath, key, *service, "Path %s for %s in port %d", path, serverName, service.Port.Port) {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			continue
+		}
+		for _, serverName := range serverNames {
+			r.own(ConflictPath, fmt.Sprintf("%s %s %s", service.Port, serverName, path), *service)
+		}
+		paths = append(paths, path)
+	}
+
+	if len(paths) == 0 {
+		log.Printf("All paths of port %d of %s in %s are in conflict, skipping it",
+			service.Port.Port, service.Name, service.Namespace)
+		return false
+	}
+	service.Paths = paths
+	return true
+}
+
+// reportConflicts logs the conflicts found in an update, creates events for
+// the services that lost them and updates the conflicts metrics
+func (c *KubernetesClient) reportConflicts(conflicts []Conflict) {
+	for _, conflict := range conflicts {
+		log.Printf("%s, ignoring it", conflict.Message)
+		c.events.ServiceEventf(conflict.Service.source, v1.EventTypeWarning, "Conflict", "%s", conflict.Message)
+	}
+	setConflictsMetric(conflicts)
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func conflictService(name string, age time.Duration, port PortSpec, external ...string) ServiceInformation {
+	return ServiceInformation{
+		Name:      name,
+		Namespace: "test",
+		Port:      port,
+		External:  external,
+		source: &v1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:              name,
+				Namespace:         "test",
+				CreationTimestamp: meta_v1.NewTime(time.Now().Add(-age)),
+			},
+		},
+	}
+}
+
+func TestResolveConflicts(t *testing.T) {
+	if err := initServerNameTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	http := PortSpec{IP: net.IPv4zero, Port: 80, Mode: "http", Protocol: "tcp"}
+	tcp := PortSpec{IP: net.IPv4zero, Port: 5432, Mode: "tcp", Protocol: "tcp"}
+	services := []ServiceInformation{
+		conflictService("new-db", time.Hour, tcp),
+		conflictService("old-db", 2*time.Hour, tcp),
+		conflictService("new-web", time.Hour, http, "shop.example.com", "new.example.com"),
+		conflictService("old-web", 2*time.Hour, http, "shop.example.com"),
+		conflictService("impostor", 30*time.Minute, http, "old-web.test.svc.local"),
+	}
+
+	resolved, conflicts := resolveConflicts(services, "local")
+	resolvedMap := make(map[string]ServiceInformation)
+	for _, service := range resolved {
+		resolvedMap[service.Name] = service
+	}
+
+	assert.Len(t, resolved, 4)
+	assert.Contains(t, resolvedMap, "old-db")
+	assert.NotContains(t, resolvedMap, "new-db")
+	assert.Equal(t, []string{"shop.example.com"}, resolvedMap["old-web"].External)
+	assert.Equal(t, []string{"new.example.com"}, resolvedMap["new-web"].External)
+	assert.Contains(t, resolvedMap, "impostor", "conflicting external domains should be removed")
+	assert.Empty(t, resolvedMap["impostor"].External)
+
+	if assert.Len(t, conflicts, 3) {
+		assert.Equal(t, ConflictPort, conflicts[0].Kind)
+		assert.Equal(t, "new-db", conflicts[0].Service.Name)
+		assert.Equal(t, "old-db", conflicts[0].Owner.Name)
+		assert.Equal(t, ConflictServerName, conflicts[1].Kind)
+		assert.Equal(t, "new-web", conflicts[1].Service.Name)
+		assert.Equal(t, ConflictServerName, conflicts[2].Kind)
+		assert.Equal(t, "impostor", conflicts[2].Service.Name)
+	}
+}
+
+func TestResolveConflictsGeneratedNames(t *testing.T) {
+	if err := initServerNameTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	http := PortSpec{IP: net.IPv4zero, Port: 80, Mode: "http", Protocol: "tcp"}
+	services := []ServiceInformation{
+		conflictService("web", time.Hour, http),
+		conflictService("squatter", 2*time.Hour, http, "web.test.svc.local"),
+	}
+
+	resolved, conflicts := resolveConflicts(services, "local")
+	if assert.Len(t, resolved, 1) {
+		assert.Equal(t, "squatter", resolved[0].Name)
+	}
+	if assert.Len(t, conflicts, 1) {
+		assert.Equal(t, "web", conflicts[0].Service.Name)
+	}
+}
+
+func TestResolvePortConflictsBetweenModes(t *testing.T) {
+	if err := initServerNameTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	ipv4 := net.ParseIP("10.0.0.1")
+	ipv6 := net.ParseIP("fd00::1")
+	http := PortSpec{IP: ipv4, IPs: []net.IP{ipv4, ipv6}, Port: 80, Mode: "http", Protocol: "tcp"}
+	tcp := PortSpec{IP: ipv6, IPs: []net.IP{ipv6}, Port: 80, Mode: "tcp", Protocol: "tcp"}
+	udp := PortSpec{IP: ipv4, Port: 80, Protocol: "udp"}
+	otherIP := PortSpec{IP: net.ParseIP("10.0.0.2"), Port: 80, Mode: "tcp", Protocol: "tcp"}
+	services := []ServiceInformation{
+		conflictService("web", 3*time.Hour, http),
+		conflictService("other-web", 2*time.Hour, http),
+		conflictService("proxy", time.Hour, tcp),
+		conflictService("dns", time.Hour, udp),
+		conflictService("other-ip", time.Hour, otherIP),
+	}
+
+	resolved, conflicts := resolveConflicts(services, "local")
+	var names []string
+	for _, service := range resolved {
+		names = append(names, service.Name)
+	}
+	assert.Equal(t, []string{"web", "other-web", "dns", "other-ip"}, names)
+	if assert.Len(t, conflicts, 1) {
+		assert.Equal(t, ConflictPort, conflicts[0].Kind)
+		assert.Equal(t, "proxy", conflicts[0].Service.Name)
+		assert.Equal(t, "web", conflicts[0].Owner.Name)
+	}
+
+	// Older services in other modes keep the port
+	services = []ServiceInformation{
+		conflictService("proxy", 2*time.Hour, tcp),
+		conflictService("web", time.Hour, http),
+	}
+	resolved, conflicts = resolveConflicts(services, "local")
+	if assert.Len(t, resolved, 1) {
+		assert.Equal(t, "proxy", resolved[0].Name)
+	}
+	if assert.Len(t, conflicts, 1) {
+		assert.Equal(t, "web", conflicts[0].Service.Name)
+	}
+}
+
+func TestReportConflicts(t *testing.T) {
+	events := newTestEvents()
+	c := &KubernetesClient{events: NewEventRecorder(events)}
+
+	tcp := PortSpec{IP: net.IPv4zero, Port: 5432, Mode: "tcp", Protocol: "tcp"}
+	_, conflicts := resolveConflicts([]ServiceInformation{
+		conflictService("new-db", time.Hour, tcp),
+		conflictService("old-db", 2*time.Hour, tcp),
+	}, "local")
+	c.reportConflicts(conflicts)
+
+	event := events.Wait(t)
+	assert.Equal(t, "new-db", event.InvolvedObject.Name)
+	assert.Equal(t, "test", event.Namespace)
+	assert.Equal(t, v1.EventTypeWarning, event.Type)
+	assert.Equal(t, "Conflict", event.Reason)
+	assert.Contains(t, event.Message, "old-db")
+
+	assert.Equal(t, "1", conflictsMetric.Get(ConflictPort).String())
+	assert.Equal(t, "0", conflictsMetric.Get(ConflictPath).String())
+}
@@ -18,21 +18,40 @@ package main
 
 import (
 	"fmt"
+	"net"
 
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/pkg/api/v1"
 )
 
 type ServiceEndpoint struct {
-	Name string
-	IP   string
-	Port int32
+	Name     string
+	IP       string
+	Hostname string
+	Port     int32
+
+	// Weight of the endpoint relative to other endpoints of the service,
+	// only set for services in traffic split groups
+	Weight int
 }
 
 func (e *ServiceEndpoint) String() string {
+	if e.IP == "" {
+		return fmt.Sprintf("%s:%d", e.Hostname, e.Port)
+	}
 	return fmt.Sprintf("%s:%d", e.IP, e.Port)
 }
 
+// HostPort returns the address of the endpoint, with IPv6 addresses enclosed
+// in brackets
+func (e *ServiceEndpoint) HostPort() string {
+	host := e.IP
+	if host == "" {
+		host = e.Hostname
+	}
+	return net.JoinHostPort(host, fmt.Sprint(e.Port))
+}
+
 type EndpointsHelper struct {
 	endpointsMap map[string]*v1.Endpoints
 }
@@ -49,12 +68,36 @@ func NewEndpointsHelper(endpoints []*v1.Endpoints) *EndpointsHelper {
 	return &EndpointsHelper{endpointsMap}
 }
 
-func (h *EndpointsHelper) ServicePortsMap(s *v1.Service) map[int32][]ServiceEndpoint {
+// ServicePortsEndpoints contains the endpoints of a service indexed by port
+// name and number, so they can be found for any port of the service
+type ServicePortsEndpoints struct {
+	byName map[string][]ServiceEndpoint
+	byPort map[int32][]ServiceEndpoint
+}
+
+func (e ServicePortsEndpoints) Len() int {
+	return len(e.byPort)
+}
+
+// Get returns the endpoints for a port of the service. Endpoints are looked
+// for by port name, as done by the endpoints controller for services with
+// selectors, and then by target port, for manually managed endpoints
+func (e ServicePortsEndpoints) Get(port v1.ServicePort) []ServiceEndpoint {
+	if endpoints, found := e.byName[port.Name]; found {
+		return endpoints
+	}
+	return e.byPort[port.TargetPort.IntVal]
+}
+
+func (h *EndpointsHelper) ServicePortsMap(s *v1.Service) ServicePortsEndpoints {
+	m := ServicePortsEndpoints{
+		byName: make(map[string][]ServiceEndpoint),
+		byPort: make(map[int32][]ServiceEndpoint),
+	}
 	endpoints, found := h.endpointsMap[metaKey(s.ObjectMeta)]
 	if !found {
-		return nil
+		return m
 	}
-	m := make(map[int32][]ServiceEndpoint)
 	for _, subset := range endpoints.Subsets {
 		for _, port := range subset.Ports {
 			var addresses []ServiceEndpoint
@@ -72,8 +115,51 @@ func (h *EndpointsHelper) ServicePortsMap(s *v1.Service) map[int32][]ServiceEndp
 					Port: port.Port,
 				})
 			}
-			m[port.Port] = addresses
+			if len(addresses) == 0 {
+				continue
+			}
+			m.byName[port.Name] = append(m.byName[port.Name], addresses...)
+			m.byPort[port.Port] = append(m.byPort[port.Port], addresses...)
 		}
 	}
 	return m
 }
+
+const (
+	ExternalNameResolutionDNS    = "dns"
+	ExternalNameResolutionStatic = "static"
+)
+
+// ExternalNameEndpoints returns the endpoints for a port of a service of type
+// ExternalName. With DNS resolution the name is resolved by the load balancer,
+// with static resolution it is resolved in background by kube2lb
+func ExternalNameEndpoints(s *v1.Service, port v1.ServicePort, resolution string) ([]ServiceEndpoint, error) {
+	targetPort := port.TargetPort.IntVal
+	if targetPort == 0 {
+		targetPort = port.Port
+	}
+
+	switch resolution {
+	case ExternalNameResolutionDNS:
+		return []ServiceEndpoint{
+			{Name: s.Spec.ExternalName, Hostname: s.Spec.ExternalName, Port: targetPort},
+		}, nil
+	case ExternalNameResolutionStatic:
+		addresses, err := hostResolver.Lookup(s.Spec.ExternalName)
+		if err != nil {
+			return nil, err
+		}
+		endpoints := make([]ServiceEndpoint, len(addresses))
+		for i, address := range addresses {
+			endpoints[i] = ServiceEndpoint{
+				Name:     address,
+				IP:       address,
+				Hostname: s.Spec.ExternalName,
+				Port:     targetPort,
+			}
+		}
+		return endpoints, nil
+	default:
+		return nil, fmt.Errorf("unknown resolution mode '%s'", resolution)
+	}
+}
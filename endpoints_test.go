@@ -0,0 +1,59 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestServicePortsMapWithoutReadyAddresses(t *testing.T) {
+	meta := meta_v1.ObjectMeta{Name: "web", Namespace: "test"}
+	helper := NewEndpointsHelper([]*v1.Endpoints{{
+		ObjectMeta: meta,
+		Subsets: []v1.EndpointSubset{
+			{
+				NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+				Ports:             []v1.EndpointPort{{Name: "http", Port: 8080}},
+			},
+			{
+				Addresses: []v1.EndpointAddress{{IP: "10.0.0.2"}},
+				Ports:     []v1.EndpointPort{{Name: "https", Port: 8443}},
+			},
+		},
+	}})
+
+	m := helper.ServicePortsMap(&v1.Service{ObjectMeta: meta})
+	assert.Equal(t, 1, m.Len(), "ports without ready addresses shouldn't be included")
+	assert.Empty(t, m.Get(v1.ServicePort{Name: "http", TargetPort: intstr.FromInt(8080)}))
+	if endpoints := m.Get(v1.ServicePort{Name: "https", TargetPort: intstr.FromInt(8443)}); assert.Len(t, endpoints, 1) {
+		assert.Equal(t, "10.0.0.2:8443", endpoints[0].String())
+	}
+
+	helper = NewEndpointsHelper([]*v1.Endpoints{{
+		ObjectMeta: meta,
+		Subsets: []v1.EndpointSubset{{
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:             []v1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}})
+	assert.Equal(t, 0, helper.ServicePortsMap(&v1.Service{ObjectMeta: meta}).Len(), "services without ready addresses shouldn't have endpoints")
+}
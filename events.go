@@ -0,0 +1,173 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	core_v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+var recordEvents = false
+var eventsInterval = 10 * time.Minute
+
+// Maximum rate of events creation, to avoid overloading the API server
+const (
+	eventsQPS   = 1
+	eventsBurst = 25
+)
+
+func init() {
+	flag.BoolVar(&recordEvents, "events", recordEvents, "Report problems with services as Kubernetes events")
+	flag.DurationVar(&eventsInterval, "events-interval", eventsInterval, "Minimum interval between repeated events")
+}
+
+// EventRecorder creates events about kubernetes objects, a nil recorder
+// can be used and does nothing. Repeated events are only created once per
+// interval, and the rate of events creation is limited.
+type EventRecorder struct {
+	sync.Mutex
+
+	events   core_v1.EventsGetter
+	host     string
+	limiter  flowcontrol.RateLimiter
+	interval time.Duration
+	recorded map[string]time.Time
+}
+
+func NewEventRecorder(events core_v1.EventsGetter) *EventRecorder {
+	host, _ := os.Hostname()
+	return &EventRecorder{
+		events:   events,
+		host:     host,
+		limiter:  flowcontrol.NewTokenBucketRateLimiter(eventsQPS, eventsBurst),
+		interval: eventsInterval,
+		recorded: make(map[string]time.Time),
+	}
+}
+
+// shouldRecord decides if an event has to be created, it returns false for
+// events already created in the current interval, or if the rate limit is
+// exceeded
+func (r *EventRecorder) shouldRecord(key string, now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	for k, t := range r.recorded {
+		if now.Sub(t) >= r.interval {
+			delete(r.recorded, k)
+		}
+	}
+	if _, found := r.recorded[key]; found {
+		return false
+	}
+	if !r.limiter.TryAccept() {
+		eventsDroppedMetric.Add(1)
+		return false
+	}
+	r.recorded[key] = now
+	return true
+}
+
+// serviceWarningf logs a problem with a service and reports it as a warning
+// event, so it's visible to the owners of the service
+func (c *KubernetesClient) serviceWarningf(s *v1.Service, reason, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Print(message)
+	c.events.ServiceEventf(s, v1.EventTypeWarning, reason, "%s", message)
+}
+
+// configMapWarningf logs a problem with a config map and reports it as a
+// warning event
+func (c *KubernetesClient) configMapWarningf(cm *v1.ConfigMap, reason, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Print(message)
+	c.events.Eventf(&v1.ObjectReference{
+		Kind:            "ConfigMap",
+		APIVersion:      "v1",
+		Namespace:       cm.Namespace,
+		Name:            cm.Name,
+		UID:             cm.UID,
+		ResourceVersion: cm.ResourceVersion,
+	}, v1.EventTypeWarning, reason, "%s", message)
+}
+
+func serviceReference(s *v1.Service) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:            "Service",
+		APIVersion:      "v1",
+		Namespace:       s.Namespace,
+		Name:            s.Name,
+		UID:             s.UID,
+		ResourceVersion: s.ResourceVersion,
+	}
+}
+
+// ServiceEventf creates an event about a service
+func (r *EventRecorder) ServiceEventf(s *v1.Service, eventType, reason, format string, args ...interface{}) {
+	if r == nil || s == nil {
+		return
+	}
+	r.Eventf(serviceReference(s), eventType, reason, format, args...)
+}
+
+// Eventf creates an event about an object, events are created in background
+// so updates are not delayed by the API server
+func (r *EventRecorder) Eventf(ref *v1.ObjectReference, eventType, reason, format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+
+	message := fmt.Sprintf(format, args...)
+	key := fmt.Sprintf("%s/%s/%s/%s %s %s %s", ref.Kind, ref.Namespace, ref.Name, ref.UID, eventType, reason, message)
+	now := meta_v1.NewTime(time.Now())
+	if !r.shouldRecord(key, now.Time) {
+		return
+	}
+
+	event := &v1.Event{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", ref.Name, now.UnixNano()),
+			Namespace: ref.Namespace,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        message,
+		Source: v1.EventSource{
+			Component: "kube2lb",
+			Host:      r.host,
+		},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+
+	go func() {
+		if _, err := r.events.Events(ref.Namespace).Create(event); err != nil {
+			log.Printf("Couldn't create event about %s %s in %s: %s", ref.Kind, ref.Name, ref.Namespace, err)
+		}
+	}()
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	core_v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+type testEvents struct {
+	core_v1.EventInterface
+
+	created chan *v1.Event
+}
+
+func newTestEvents() *testEvents {
+	return &testEvents{created: make(chan *v1.Event, 10)}
+}
+
+func (e *testEvents) Events(string) core_v1.EventInterface {
+	return e
+}
+
+func (e *testEvents) Create(event *v1.Event) (*v1.Event, error) {
+	e.created <- event
+	return event, nil
+}
+
+func (e *testEvents) Wait(t *testing.T) *v1.Event {
+	select {
+	case event := <-e.created:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("event creation timeout")
+	}
+	return nil
+}
+
+func (e *testEvents) AssertNone(t *testing.T) {
+	select {
+	case event := <-e.created:
+		t.Fatalf("unexpected event: %s", event.Message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEventRecorderDeduplication(t *testing.T) {
+	events := newTestEvents()
+	r := NewEventRecorder(events)
+	s := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "test", Namespace: "default", UID: "1234"}}
+
+	r.ServiceEventf(s, v1.EventTypeWarning, "NoEndpoints", "no endpoints for %s", s.Name)
+	event := events.Wait(t)
+	assert.Equal(t, "no endpoints for test", event.Message)
+	assert.Equal(t, "default", event.Namespace)
+	assert.Equal(t, "Service", event.InvolvedObject.Kind)
+	assert.Equal(t, "1234", string(event.InvolvedObject.UID))
+	assert.Equal(t, "kube2lb", event.Source.Component)
+
+	r.ServiceEventf(s, v1.EventTypeWarning, "NoEndpoints", "no endpoints for %s", s.Name)
+	events.AssertNone(t)
+
+	r.ServiceEventf(s, v1.EventTypeWarning, "ValidationFailed", "invalid")
+	assert.Equal(t, "ValidationFailed", events.Wait(t).Reason)
+
+	r.interval = 0
+	r.ServiceEventf(s, v1.EventTypeWarning, "NoEndpoints", "no endpoints for %s", s.Name)
+	assert.Equal(t, "NoEndpoints", events.Wait(t).Reason)
+}
+
+func TestEventRecorderRateLimit(t *testing.T) {
+	events := newTestEvents()
+	r := NewEventRecorder(events)
+	s := &v1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "test", Namespace: "default"}}
+
+	dropped := eventsDroppedMetric.Value()
+	for i := 0; i < eventsBurst+5; i++ {
+		r.ServiceEventf(s, v1.EventTypeWarning, "Test", "event %d", i)
+	}
+	for i := 0; i < eventsBurst; i++ {
+		events.Wait(t)
+	}
+	events.AssertNone(t)
+	assert.Equal(t, dropped+5, eventsDroppedMetric.Value())
+}
+
+func TestNilEventRecorder(t *testing.T) {
+	var r *EventRecorder
+	r.ServiceEventf(&v1.Service{}, v1.EventTypeWarning, "Test", "nothing happens")
+
+	c := &KubernetesClient{}
+	c.serviceWarningf(&v1.Service{}, "Test", "nothing happens")
+}
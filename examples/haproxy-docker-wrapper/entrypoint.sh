@@ -22,6 +22,9 @@ sed -i $TEMPLATE \
 	-e "s/__HAPROXY_TIMEOUT_SERVER__/$HAPROXY_TIMEOUT_SERVER/" \
 	-e "s/__HAPROXY_TIMEOUT_KEEPALIVE__/$HAPROXY_TIMEOUT_KEEPALIVE/" \
 	-e "s/__HAPROXY_TIMEOUT_TUNNEL__/$HAPROXY_TIMEOUT_TUNNEL/" \
+	-e "s/__HAPROXY_INGRESS_BIND__/$HAPROXY_INGRESS_BIND/" \
+	-e "s/__HAPROXY_INGRESS_TLS_BIND__/$HAPROXY_INGRESS_TLS_BIND/" \
+	-e "s/__HAPROXY_NAMESERVER__/$HAPROXY_NAMESERVER/" \
 	-e "s/__SYSLOG__/$SYSLOG/"
 
-exec kube2lb -apiserver="$APISERVER" -kubecfg="$KUBECFG" -template="$TEMPLATE" -server-name-templates="$SERVER_NAME_TEMPLATES" -config="$CONFFILE" -domain="$DOMAIN" -default-lb-ip="$DEFAULT_LB_IP" -notify=command:"curl -s http://$HAPROXY_WRAPPER_CONTROL/reload"
+exec kube2lb -apiserver="$APISERVER" -kubecfg="$KUBECFG" -template="$TEMPLATE" -server-name-templates="$SERVER_NAME_TEMPLATES" -config="$CONFFILE" -domain="$DOMAIN" -default-lb-ip="$DEFAULT_LB_IP" -ingresses="$INGRESSES" -ingress-class="$INGRESS_CLASS" -tls-dir="$TLS_DIR" -notify=command:"curl -s http://$HAPROXY_WRAPPER_CONTROL/reload"
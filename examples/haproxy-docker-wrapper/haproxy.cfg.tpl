@@ -1,6 +1,8 @@
 {{ $services := .Services -}}
 {{ $domain := .Domain -}}
 {{ $ports := .Ports -}}
+{{ $ingresses := .Ingresses -}}
+{{ $acmeAddress := .ACMEHTTPAddress -}}
 {{ $nbproc := __HAPROXY_NBPROC__ -}}
 {{ $nbthread := __HAPROXY_NBTHREAD__ -}}
 global
@@ -27,13 +29,23 @@ defaults
 	timeout http-keep-alive __HAPROXY_TIMEOUT_KEEPALIVE__
 	timeout tunnel  __HAPROXY_TIMEOUT_TUNNEL__
 
-{{ range $i, $port := $ports }}
+resolvers kube2lb
+	nameserver dns1 __HAPROXY_NAMESERVER__
+	hold valid 10s
+
+{{ range $i, $port := $ports }}{{ if eq $port.Protocol "tcp" }}
 frontend frontend_{{ $port }}
-	bind {{ $port.IP }}:{{ $port.Port }}
+{{- $certificates := PortCertificates $services $port }}
+{{- range $ip := $port.IPs }}
+	bind {{ $ip }}:{{ $port.Port }}{{ if IsIPv6 $ip }} v6only{{ end }}{{ if $certificates }} ssl{{ range $certificates }} crt {{ . }}{{ end }}{{ end }}
+{{- end }}
 	maxconn __HAPROXY_FRONTEND_MAXCONN__
 {{- if eq $port.Mode "http" }}
 	option httplog
 	option forwardfor if-none
+{{- if $acmeAddress }}
+	use_backend acme_challenges if { path_beg /.well-known/acme-challenge/ }
+{{- end }}
 {{- end }}
 {{- range $i, $service := $services }}
 {{- if eq $service.Port.String $port.String }}
@@ -45,7 +57,6 @@ frontend frontend_{{ $port }}
 	acl svc_{{ $service }} hdr_dom(host) -i {{ $serverName }}
 	{{- end }}
 	{{- end }}
-	use_backend backend_{{ $service }} if svc_{{ $service }}
 {{- end }}
 {{- if eq $port.Mode "tcp" }}
 	mode   tcp
@@ -55,11 +66,26 @@ frontend frontend_{{ $port }}
 {{- end }}
 {{- end }}
 {{- end }}
-{{ end }}
+{{- if eq $port.Mode "http" }}
+{{ range $route := PathRoutes $services }}
+{{- if eq $route.Service.Port.String $port.String }}
+{{- with $route.Path }}
+	{{- if .IsRegexp }}
+	use_backend backend_{{ $route.Service }} if svc_{{ $route.Service }} { path_reg {{ .Regexp }} }
+	{{- else }}
+	use_backend backend_{{ $route.Service }} if svc_{{ $route.Service }} { path_beg {{ .Path }} }
+	{{- end }}
+{{- else }}
+	use_backend backend_{{ $route.Service }} if svc_{{ $route.Service }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{ end }}{{ end }}
 
-{{- range $i, $service := $services }}
+{{- range $i, $service := $services }}{{ if eq $service.Port.Protocol "tcp" }}
 backend backend_{{ $service }}
-	balance leastconn
+	balance {{ or $service.Balance "leastconn" }}
 {{- if eq $service.Port.Mode "http" }}
 	option httplog
 	option http-server-close
@@ -70,7 +96,65 @@ backend backend_{{ $service }}
 {{- end }}
 {{- if gt $service.Timeout 0 }}
 	timeout server {{ $service.Timeout }}
+{{- end }}
+{{- with $service.HealthCheck }}
+{{- if and .Path (eq $service.Port.Mode "http") }}
+	option httpchk GET {{ .Path }}
+{{- if .ExpectedStatus }}
+	http-check expect status {{ .ExpectedStatus }}
+{{- end }}
+{{- end }}
+{{- end }}
+{{- with $service.SessionAffinity }}
+{{- if .Cookie }}
+	cookie {{ .Cookie }} insert indirect nocache
+{{- else if .ClientIP }}
+	stick-table type ip size 200k expire {{ .Timeout }}s
+	stick on src
+{{- end }}
+{{- end }}
+{{- range $path := $service.Paths }}
+{{- if and $path.StripPrefix (not $path.IsRegexp) }}
+	http-request set-path %[path,regsub(^{{ $path }}/?,/)] if { path_beg {{ $path }} }
+{{- end }}
 {{- end }}
 	{{ range $i, $endpoint := $service.Endpoints }}
+	server {{ EscapeNode $endpoint.Name }} {{ $endpoint }} maxconn {{ or $service.MaxConnections __HAPROXY_SERVER_MAXCONN__ }} check inter {{ with $service.HealthCheck }}{{ if .Interval }}{{ .Interval }}{{ else }}5s{{ end }}{{ else }}5s{{ end }} downinter 10s slowstart 60s
+	{{- if $service.TrafficSplit }} weight {{ $endpoint.Weight }}{{ end }}
+	{{- with $service.SessionAffinity }}{{ if .Cookie }} cookie {{ EscapeNode $endpoint.Name }}{{ end }}{{ end }}
+	{{- if eq $service.Resolution "dns" }} resolvers kube2lb init-addr none{{ end }}{{ end }}
+{{ end }}{{ end }}
+
+{{- if $ingresses }}
+frontend frontend_ingress
+	bind __HAPROXY_INGRESS_BIND__
+{{- $ingressCertificates := IngressCertificates $ingresses }}
+{{- if $ingressCertificates }}
+	bind __HAPROXY_INGRESS_TLS_BIND__ ssl{{ range $ingressCertificates }} crt {{ . }}{{ end }}
+{{- end }}
+	maxconn __HAPROXY_FRONTEND_MAXCONN__
+	option httplog
+	option forwardfor if-none
+{{- range $route := IngressRoutes $ingresses }}
+	use_backend ingress_{{ $route.Backend }}{{ if or $route.Host $route.Path }} if{{ if $route.Host }} { hdr(host),field(1,:) -i {{ $route.Host }} }{{ end }}{{ if $route.Path }} { path_beg {{ $route.Path }} }{{ end }}{{ end }}
+{{- end }}
+{{- range $ingress := $ingresses }}
+{{- if $ingress.DefaultBackend }}
+	use_backend ingress_{{ $ingress.DefaultBackend }}
+{{- end }}
+{{- end }}
+
+{{ range $i, $backend := IngressBackends $ingresses -}}
+backend ingress_{{ $backend }}
+	balance leastconn
+	option httplog
+	option http-server-close
+	{{ range $i, $endpoint := $backend.Endpoints }}
 	server {{ EscapeNode $endpoint.Name }} {{ $endpoint }} maxconn __HAPROXY_SERVER_MAXCONN__ check inter 5s downinter 10s slowstart 60s{{ end }}
 {{ end }}
+{{- end }}
+
+{{- if $acmeAddress }}
+backend acme_challenges
+	server kube2lb {{ $acmeAddress }}
+{{- end }}
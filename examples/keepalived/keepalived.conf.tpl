@@ -0,0 +1,50 @@
+{{ $services := .Services -}}
+{{ $nodes := .Nodes -}}
+{{- /* Set to true to send traffic to node ports instead of to endpoints */ -}}
+{{ $useNodePorts := false -}}
+global_defs {
+	router_id kube2lb
+}
+
+{{- define "real_server" }}
+	real_server {{ .IP }} {{ .Port }} {
+		weight {{ .Weight }}
+	{{- with .Check }}
+		{{ .Type }} {
+		{{- if eq .Type "HTTP_GET" }}
+			url {
+				path {{ .Path }}
+				status_code {{ .Status }}
+			}
+		{{- end }}
+			connect_timeout 3
+		}
+	{{- end }}
+	}
+{{- end }}
+
+{{- range $i, $service := $services }}
+{{- /* HTTP ports need routing by server name, they are left to other balancers */}}
+{{- if ne $service.Port.Mode "http" }}
+{{- range $vip := VirtualServerIPs $service.Port }}
+
+# {{ $service.Namespace }}/{{ $service.Name }}:{{ $service.PortName }}
+virtual_server {{ $vip }} {{ $service.Port.Port }} {
+	delay_loop {{ DelayLoop $service }}
+	lb_algo {{ LVSScheduler $service }}
+	lb_kind NAT
+	protocol {{ ToUpper $service.Port.Protocol }}
+{{- with $service.SessionAffinity }}
+{{- if .ClientIP }}
+	persistence_timeout {{ .Timeout }}
+{{- end }}
+{{- end }}
+{{- if $useNodePorts }}
+{{- range NodeRealServers $service $nodes $vip }}{{ template "real_server" . }}{{ end }}
+{{- else }}
+{{- range EndpointRealServers $service $vip }}{{ template "real_server" . }}{{ end }}
+{{- end }}
+}
+{{- end }}
+{{- end }}
+{{- end }}
@@ -0,0 +1,39 @@
+{{ $services := .Services -}}
+worker_processes auto;
+
+events {
+	worker_connections 1024;
+}
+
+stream {
+	log_format kube2lb '$remote_addr [$time_local] $protocol $server_port $status $bytes_sent $bytes_received $session_time "$upstream_addr"';
+	access_log /dev/stdout kube2lb;
+
+{{- range $i, $service := $services }}
+{{- /* HTTP ports are left to other balancers, nginx doesn't support SCTP nor empty upstreams */}}
+{{- if and (ne $service.Port.Mode "http") (ne $service.Port.Protocol "sctp") $service.Endpoints }}
+
+	upstream {{ NginxName $service }} {
+	{{- with NginxBalance $service }}
+		{{ . }};
+	{{- end }}
+	{{- range $j, $endpoint := $service.Endpoints }}
+		server {{ $endpoint.HostPort }}{{ if $service.MaxConnections }} max_conns={{ $service.MaxConnections }}{{ end }}{{ if $service.TrafficSplit }}{{ if $endpoint.Weight }} weight={{ $endpoint.Weight }}{{ else }} down{{ end }}{{ end }};
+	{{- end }}
+	}
+
+	server {
+	{{- range $ip := $service.Port.IPs }}
+		listen {{ NginxListen $service.Port $ip false }};
+	{{- end }}
+		proxy_pass {{ NginxName $service }};
+	{{- if gt $service.Timeout 0 }}
+		proxy_timeout {{ $service.Timeout }}ms;
+	{{- end }}
+	{{- if eq $service.Port.Protocol "udp" }}
+		proxy_responses 1;
+	{{- end }}
+	}
+{{- end }}
+{{- end }}
+}
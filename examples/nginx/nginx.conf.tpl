@@ -0,0 +1,112 @@
+{{ $services := .Services -}}
+{{ $ports := .Ports -}}
+{{ $domain := .Domain -}}
+{{ $acmeAddress := .ACMEHTTPAddress -}}
+worker_processes auto;
+
+events {
+	worker_connections 1024;
+}
+
+{{- define "upstream" }}
+
+	upstream {{ NginxName . }} {
+	{{- with NginxBalance . }}
+		{{ . }};
+	{{- end }}
+	{{- $service := . }}
+	{{- range $i, $endpoint := .Endpoints }}
+		server {{ $endpoint.HostPort }}{{ if $service.MaxConnections }} max_conns={{ $service.MaxConnections }}{{ end }}{{ if $service.TrafficSplit }}{{ if $endpoint.Weight }} weight={{ $endpoint.Weight }}{{ else }} down{{ end }}{{ end }};
+	{{- end }}
+	}
+{{- end }}
+
+http {
+	access_log /dev/stdout;
+	server_names_hash_bucket_size 128;
+
+	proxy_http_version 1.1;
+	proxy_set_header Connection "";
+	proxy_set_header Host $host;
+	proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+	proxy_set_header X-Forwarded-Proto $scheme;
+
+{{- range $i, $service := $services }}
+{{- if and (eq $service.Port.Mode "http") $service.Endpoints }}{{ template "upstream" $service }}{{ end }}
+{{- end }}
+{{- if $acmeAddress }}
+
+	upstream acme_challenges {
+		server {{ $acmeAddress }};
+	}
+{{- end }}
+
+{{- range $i, $port := $ports }}
+{{- if eq $port.Mode "http" }}
+{{- $ssl := ne (len (PortCertificates $services $port)) 0 }}
+{{- range $j, $host := NginxVirtualHosts $services $port $domain }}
+
+	server {
+	{{- range $ip := $port.IPs }}
+		listen {{ NginxListen $port $ip $ssl }};
+	{{- end }}
+		server_name {{ $host.ServerName }};
+	{{- if $host.CertFile }}
+		ssl_certificate {{ $host.CertFile }};
+		ssl_certificate_key {{ $host.CertFile }};
+	{{- end }}
+	{{- if $acmeAddress }}
+
+		location /.well-known/acme-challenge/ {
+			proxy_pass http://acme_challenges;
+		}
+	{{- end }}
+	{{- range $k, $location := $host.Locations }}
+
+		location {{ $location.Match }} {
+		{{- if $location.Rewrite }}
+			rewrite {{ $location.Rewrite }} /$1 break;
+		{{- end }}
+		{{- if $location.Timeout }}
+			proxy_read_timeout {{ $location.Timeout }}ms;
+		{{- end }}
+		{{- if $location.Upstream }}
+			proxy_pass http://{{ $location.Upstream }};
+		{{- else }}
+			return 503;
+		{{- end }}
+		}
+	{{- end }}
+	{{- if not $host.HasRoot }}
+
+		location / {
+			return 404;
+		}
+	{{- end }}
+	}
+{{- end }}
+{{- end }}
+{{- end }}
+}
+
+stream {
+{{- range $i, $service := $services }}
+{{- /* nginx doesn't support SCTP nor empty upstreams */}}
+{{- if and (ne $service.Port.Mode "http") (ne $service.Port.Protocol "sctp") $service.Endpoints }}
+{{- template "upstream" $service }}
+
+	server {
+	{{- range $ip := $service.Port.IPs }}
+		listen {{ NginxListen $service.Port $ip false }};
+	{{- end }}
+		proxy_pass {{ NginxName $service }};
+	{{- if $service.Timeout }}
+		proxy_timeout {{ $service.Timeout }}ms;
+	{{- end }}
+	{{- if eq $service.Port.Protocol "udp" }}
+		proxy_responses 1;
+	{{- end }}
+	}
+{{- end }}
+{{- end }}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/http2"
+)
+
+// Minimal gRPC server for the streaming methods used by envoy, served over
+// HTTP/2 without TLS, as envoy connects to its management servers
+
+// gRPC status codes used by this server
+const (
+	grpcStatusOK            = 0
+	grpcStatusUnknown       = 2
+	grpcStatusUnimplemented = 12
+)
+
+// Messages bigger than this are rejected, envoy requests are small
+const grpcMaxMessageSize = 4 * 1024 * 1024
+
+// grpcStreamHandler handles a bidirectional stream, the stream is finished
+// when it returns
+type grpcStreamHandler func(stream *grpcStream) error
+
+// grpcStream sends and receives length-prefixed protobuf messages over an
+// HTTP/2 request
+type grpcStream struct {
+	request *http.Request
+	writer  http.ResponseWriter
+}
+
+// Recv reads the next message of the stream, io.EOF is returned when the
+// client closes its side of the stream
+func (s *grpcStream) Recv(m proto.Message) error {
+	return readGRPCMessage(s.request.Body, m)
+}
+
+// Send writes a message to the stream, it is sent immediately
+func (s *grpcStream) Send(m proto.Message) error {
+	if err := writeGRPCMessage(s.writer, m); err != nil {
+		return err
+	}
+	s.writer.(http.Flusher).Flush()
+	return nil
+}
+
+// Done returns a channel closed when the client finishes the stream
+func (s *grpcStream) Done() <-chan struct{} {
+	return s.request.Context().Done()
+}
+
+// readGRPCMessage reads a message prefixed by its compression flag and its
+// length, compressed messages are not supported
+func readGRPCMessage(r io.Reader, m proto.Message) error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return err
+	}
+	if prefix[0] != 0 {
+		return fmt.Errorf("compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > grpcMaxMessageSize {
+		return fmt.Errorf("message of %d bytes is too big", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// writeGRPCMessage writes an uncompressed message prefixed by its length
+func writeGRPCMessage(w io.Writer, m proto.Message) error {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	message := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(message[1:], uint32(len(data)))
+	copy(message[5:], data)
+	_, err = w.Write(message)
+	return err
+}
+
+// grpcServer serves streaming methods, handlers are indexed by the full name
+// of the method, as "/package.Service/Method"
+type grpcServer map[string]grpcStreamHandler
+
+func (g grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "only gRPC requests are served", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	handler, found := g[r.URL.Path]
+	if !found {
+		// Responses without messages send the status in the headers
+		w.Header().Set("Grpc-Status", fmt.Sprint(grpcStatusUnimplemented))
+		w.Header().Set("Grpc-Message", "unknown method "+r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Headers are sent before any message so clients can start the stream
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	status := grpcStatusOK
+	err := handler(&grpcStream{request: r, writer: w})
+	if err != nil {
+		log.Printf("gRPC stream %s finished with error: %s", r.URL.Path, err)
+		status = grpcStatusUnknown
+		w.Header().Set(http2.TrailerPrefix+"Grpc-Message", err.Error())
+	}
+	w.Header().Set(http2.TrailerPrefix+"Grpc-Status", fmt.Sprint(status))
+}
+
+// Serve accepts HTTP/2 connections without TLS in the listener, clients are
+// expected to start them with prior knowledge, as envoy does
+func (g grpcServer) Serve(listener net.Listener) error {
+	server := &http2.Server{}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn, &http2.ServeConnOpts{Handler: g})
+	}
+}
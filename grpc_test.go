@@ -0,0 +1,119 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+// newTestH2CTransport returns a transport that uses HTTP/2 without TLS, as
+// gRPC clients do
+func newTestH2CTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+}
+
+func TestGRPCMessages(t *testing.T) {
+	var buffer bytes.Buffer
+	request := &xdsDiscoveryRequest{TypeURL: XDSClusterType, ResourceNames: []string{"a", "b"}}
+	if assert.NoError(t, writeGRPCMessage(&buffer, request)) {
+		assert.Equal(t, byte(0), buffer.Bytes()[0], "messages are not compressed")
+	}
+	if !assert.NoError(t, writeGRPCMessage(&buffer, &xdsDiscoveryRequest{})) {
+		return
+	}
+
+	var decoded xdsDiscoveryRequest
+	if assert.NoError(t, readGRPCMessage(&buffer, &decoded)) {
+		assert.Equal(t, request, &decoded)
+	}
+	assert.NoError(t, readGRPCMessage(&buffer, &decoded), "empty messages")
+	assert.Equal(t, io.EOF, readGRPCMessage(&buffer, &decoded))
+
+	truncated := bytes.NewReader([]byte{0, 0, 0, 0, 10, 1})
+	assert.Equal(t, io.ErrUnexpectedEOF, readGRPCMessage(truncated, &decoded))
+	compressed := bytes.NewReader([]byte{1, 0, 0, 0, 0})
+	assert.Error(t, readGRPCMessage(compressed, &decoded))
+}
+
+func TestGRPCServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// Echoes received messages till the client closes the stream
+	server := grpcServer{"/test.Echo/Stream": func(stream *grpcStream) error {
+		for {
+			var m xdsDiscoveryRequest
+			if err := stream.Recv(&m); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := stream.Send(&m); err != nil {
+				return err
+			}
+		}
+	}}
+	go server.Serve(listener)
+
+	call := func(method string, body io.Reader) *http.Response {
+		request, _ := http.NewRequest(http.MethodPost, "http://"+listener.Addr().String()+method, body)
+		request.Header.Set("Content-Type", "application/grpc")
+		resp, err := newTestH2CTransport().RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	var messages bytes.Buffer
+	writeGRPCMessage(&messages, &xdsDiscoveryRequest{TypeURL: "a"})
+	writeGRPCMessage(&messages, &xdsDiscoveryRequest{TypeURL: "b"})
+	resp := call("/test.Echo/Stream", &messages)
+	var echoed []string
+	for {
+		var m xdsDiscoveryRequest
+		if err := readGRPCMessage(resp.Body, &m); err != nil {
+			break
+		}
+		echoed = append(echoed, m.TypeURL)
+	}
+	resp.Body.Close()
+	assert.Equal(t, []string{"a", "b"}, echoed)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+
+	resp = call("/test.Echo/Unknown", nil)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "12", resp.Header.Get("Grpc-Status"), "unknown methods are unimplemented")
+}
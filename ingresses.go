@@ -0,0 +1,262 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+const IngressClassAnnotation = "kubernetes.io/ingress.class"
+
+var watchIngresses = false
+var ingressClass = "kube2lb"
+
+func init() {
+	flag.BoolVar(&watchIngresses, "ingresses", watchIngresses, "Watch ingress resources and pass their routing rules to templates")
+	flag.StringVar(&ingressClass, "ingress-class", ingressClass, "Only ingresses without class or with this class are considered")
+}
+
+type IngressBackendInformation struct {
+	Service   string
+	Namespace string
+	Port      int32
+	NodePort  int32
+	Endpoints []ServiceEndpoint
+}
+
+// String representation of an ingress backend, intended to be used as config label
+func (b IngressBackendInformation) String() string {
+	return fmt.Sprintf("%s_%s_%d", b.Service, b.Namespace, b.Port)
+}
+
+type IngressPathInformation struct {
+	Path    string
+	Backend IngressBackendInformation
+}
+
+type IngressRuleInformation struct {
+	Host  string
+	Paths []IngressPathInformation
+}
+
+type IngressTLSInformation struct {
+	Hosts      []string
+	SecretName string
+	CertFile   string
+	SNI        []string
+}
+
+type IngressInformation struct {
+	Name           string
+	Namespace      string
+	Rules          []IngressRuleInformation
+	TLS            []IngressTLSInformation
+	DefaultBackend *IngressBackendInformation
+}
+
+func isIngressClassHandled(i *v1beta1.Ingress) bool {
+	class, found := i.ObjectMeta.Annotations[IngressClassAnnotation]
+	return !found || class == "" || class == ingressClass
+}
+
+type servicesHelper struct {
+	servicesMap     map[string]*v1.Service
+	endpointsHelper *EndpointsHelper
+}
+
+func newServicesHelper(services []*v1.Service, endpointsHelper *EndpointsHelper) *servicesHelper {
+	servicesMap := make(map[string]*v1.Service)
+	for _, service := range services {
+		servicesMap[metaKey(service.ObjectMeta)] = service
+	}
+	return &servicesHelper{servicesMap, endpointsHelper}
+}
+
+func (h *servicesHelper) backend(namespace string, b v1beta1.IngressBackend) (*IngressBackendInformation, error) {
+	key := fmt.Sprintf("%s %s", b.ServiceName, namespace)
+	s, found := h.servicesMap[key]
+	if !found {
+		return nil, fmt.Errorf("service %s not found in %s", b.ServiceName, namespace)
+	}
+	for _, port := range s.Spec.Ports {
+		switch b.ServicePort.Type {
+		case intstr.Int:
+			if port.Port != b.ServicePort.IntVal {
+				continue
+			}
+		case intstr.String:
+			if port.Name != b.ServicePort.StrVal {
+				continue
+			}
+		}
+		endpointsPortsMap := h.endpointsHelper.ServicePortsMap(s)
+		return &IngressBackendInformation{
+			Service:   s.Name,
+			Namespace: s.Namespace,
+			Port:      port.Port,
+			NodePort:  port.NodePort,
+			Endpoints: endpointsPortsMap.Get(port),
+		}, nil
+	}
+	return nil, fmt.Errorf("port %s not found in service %s in %s", b.ServicePort.String(), b.ServiceName, namespace)
+}
+
+func (c *KubernetesClient) getIngresses() ([]IngressInformation, error) {
+	ingresses, err := c.ingressStore.List()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get ingresses: %s", err)
+	}
+
+	serviceList, err := c.serviceStore.List()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get services: %s", err)
+	}
+
+	endpoints, err := c.endpointsStore.List()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get endpoints: %s", err)
+	}
+
+	services := newServicesHelper(serviceList, NewEndpointsHelper(endpoints))
+
+	ingressesInformation := make([]IngressInformation, 0, len(ingresses))
+	for _, i := range ingresses {
+		if !isIngressClassHandled(i) {
+			continue
+		}
+
+		info := IngressInformation{
+			Name:      i.Name,
+			Namespace: i.Namespace,
+		}
+
+		if i.Spec.Backend != nil {
+			backend, err := services.backend(i.Namespace, *i.Spec.Backend)
+			if err != nil {
+				log.Printf("Couldn't find default backend for ingress %s in %s: %s", i.Name, i.Namespace, err)
+			} else {
+				info.DefaultBackend = backend
+			}
+		}
+
+		for _, rule := range i.Spec.Rules {
+			if rule.HTTP == nil {
+				continue
+			}
+			ruleInfo := IngressRuleInformation{Host: rule.Host}
+			for _, path := range rule.HTTP.Paths {
+				backend, err := services.backend(i.Namespace, path.Backend)
+				if err != nil {
+					log.Printf("Couldn't find backend for path '%s' of ingress %s in %s: %s", path.Path, i.Name, i.Namespace, err)
+					continue
+				}
+				ruleInfo.Paths = append(ruleInfo.Paths, IngressPathInformation{
+					Path:    path.Path,
+					Backend: *backend,
+				})
+			}
+			if len(ruleInfo.Paths) > 0 {
+				info.Rules = append(info.Rules, ruleInfo)
+			}
+		}
+
+		for _, tls := range i.Spec.TLS {
+			tlsInfo := IngressTLSInformation{
+				Hosts:      tls.Hosts,
+				SecretName: tls.SecretName,
+			}
+			if tls.SecretName != "" && c.certificates != nil {
+				certInfo, err := c.tlsInformation(i.Namespace, tls.SecretName)
+				if err != nil {
+					log.Printf("Couldn't configure TLS for ingress %s in %s: %s", i.Name, i.Namespace, err)
+				} else {
+					tlsInfo.CertFile = certInfo.CertFile
+					tlsInfo.SNI = certInfo.SNI
+				}
+			}
+			info.TLS = append(info.TLS, tlsInfo)
+		}
+
+		if len(info.Rules) == 0 && info.DefaultBackend == nil {
+			log.Printf("Ingress %s in %s has no usable backends, skipping it", i.Name, i.Namespace)
+			continue
+		}
+		ingressesInformation = append(ingressesInformation, info)
+	}
+	return ingressesInformation, nil
+}
+
+// ingressBackends returns the list of different backends used by a list of ingresses
+func ingressBackends(ingresses []IngressInformation) []IngressBackendInformation {
+	seen := make(map[string]bool)
+	var backends []IngressBackendInformation
+	add := func(b IngressBackendInformation) {
+		if seen[b.String()] {
+			return
+		}
+		seen[b.String()] = true
+		backends = append(backends, b)
+	}
+	for _, ingress := range ingresses {
+		for _, rule := range ingress.Rules {
+			for _, path := range rule.Paths {
+				add(path.Backend)
+			}
+		}
+		if ingress.DefaultBackend != nil {
+			add(*ingress.DefaultBackend)
+		}
+	}
+	return backends
+}
+
+// IngressRoute is a path rule of an ingress, Host is empty for rules that
+// apply to any host, and Path is empty for rules that apply to any path
+type IngressRoute struct {
+	Host    string
+	Path    string
+	Backend IngressBackendInformation
+}
+
+// ingressRoutes returns the path rules of a list of ingresses sorted so more
+// specific rules are evaluated first, rules with host go before rules for any
+// host, and longest paths go first. Default backends are not included.
+func ingressRoutes(ingresses []IngressInformation) []IngressRoute {
+	var routes []IngressRoute
+	for _, ingress := range ingresses {
+		for _, rule := range ingress.Rules {
+			for _, path := range rule.Paths {
+				routes = append(routes, IngressRoute{Host: rule.Host, Path: path.Path, Backend: path.Backend})
+			}
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if (a.Host == "") != (b.Host == "") {
+			return a.Host != ""
+		}
+		return len(a.Path) > len(b.Path)
+	})
+	return routes
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+	core_v1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var lbIPPoolsArg string
+
+func init() {
+	flag.StringVar(&lbIPPoolsArg, "lb-ip-pools", "", "Comma-separated list of CIDRs or IP ranges (first-last) used to allocate IPs for LoadBalancer services without loadBalancerIP, they can be restricted to a namespace with the form namespace=pool")
+}
+
+// IPPool is a range of IPs that can be allocated to services, if namespace
+// is not empty, only services in this namespace can use it
+type IPPool struct {
+	Namespace string
+	First     net.IP
+	Last      net.IP
+}
+
+func (p *IPPool) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	return ip != nil && bytes.Compare(ip, p.First) >= 0 && bytes.Compare(ip, p.Last) <= 0
+}
+
+func (p *IPPool) String() string {
+	if p.Namespace == "" {
+		return fmt.Sprintf("%s-%s", p.First, p.Last)
+	}
+	return fmt.Sprintf("%s=%s-%s", p.Namespace, p.First, p.Last)
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func prevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+func parseIPPool(pool string) (*IPPool, error) {
+	var p IPPool
+	if i := strings.Index(pool, "="); i >= 0 {
+		p.Namespace, pool = strings.TrimSpace(pool[:i]), strings.TrimSpace(pool[i+1:])
+	}
+
+	if strings.Contains(pool, "/") {
+		ip, network, err := net.ParseCIDR(pool)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := network.Mask.Size()
+		p.First = network.IP.To16()
+		p.Last = make(net.IP, net.IPv6len)
+		copy(p.Last, p.First)
+		mask := network.Mask
+		offset := net.IPv6len - len(mask)
+		for i := range mask {
+			p.Last[offset+i] |= ^mask[i]
+		}
+		// Network and broadcast addresses cannot be used
+		if ip.To4() != nil && ones < 31 {
+			p.First, p.Last = nextIP(p.First), prevIP(p.Last)
+		} else if ip.To4() == nil && ones < bits {
+			p.First = nextIP(p.First)
+		}
+		return &p, nil
+	}
+
+	limits := strings.Split(pool, "-")
+	if len(limits) != 2 {
+		return nil, fmt.Errorf("invalid IP pool '%s'", pool)
+	}
+	p.First = net.ParseIP(strings.TrimSpace(limits[0]))
+	p.Last = net.ParseIP(strings.TrimSpace(limits[1]))
+	if p.First == nil || p.Last == nil || (p.First.To4() == nil) != (p.Last.To4() == nil) {
+		return nil, fmt.Errorf("invalid IP range '%s'", pool)
+	}
+	if bytes.Compare(p.First, p.Last) > 0 {
+		return nil, fmt.Errorf("invalid IP range '%s', first address is greater than the last one", pool)
+	}
+	return &p, nil
+}
+
+func parseIPPools(pools string) ([]*IPPool, error) {
+	var parsed []*IPPool
+	for _, pool := range strings.Split(pools, ",") {
+		pool = strings.TrimSpace(pool)
+		if pool == "" {
+			continue
+		}
+		p, err := parseIPPool(pool)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// IPAllocator allocates IPs from pools to LoadBalancer services that don't
+// request an specific IP. Allocations are stored in an annotation of the
+// services, so they are kept between restarts.
+type IPAllocator struct {
+	pools []*IPPool
+
+	// patch stores the allocated IP in the service
+	patch func(s *v1.Service, ip string) (*v1.Service, error)
+
+	// warnf reports problems with services
+	warnf func(s *v1.Service, reason, format string, args ...interface{})
+}
+
+func NewIPAllocator(pools []*IPPool, services core_v1.ServicesGetter) *IPAllocator {
+	return &IPAllocator{
+		pools: pools,
+		patch: func(s *v1.Service, ip string) (*v1.Service, error) {
+			patch, err := json.Marshal(map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{AllocatedIPAnnotation: ip},
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+			return services.Services(s.Namespace).Patch(s.Name, types.StrategicMergePatchType, patch)
+		},
+	}
+}
+
+func needsAllocatedIP(s *v1.Service) bool {
+	return s.Spec.Type == v1.ServiceTypeLoadBalancer && s.Spec.LoadBalancerIP == ""
+}
+
+// servicePools returns the pools that can be used by a service, pools of its
+// namespace if there are any, or pools without namespace otherwise
+func (a *IPAllocator) servicePools(s *v1.Service) []*IPPool {
+	var namespaced, global []*IPPool
+	for _, pool := range a.pools {
+		switch pool.Namespace {
+		case s.Namespace:
+			namespaced = append(namespaced, pool)
+		case "":
+			global = append(global, pool)
+		}
+	}
+	if len(namespaced) > 0 {
+		return namespaced
+	}
+	return global
+}
+
+func (a *IPAllocator) inServicePools(s *v1.Service, ip net.IP) bool {
+	for _, pool := range a.servicePools(s) {
+		if pool.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *IPAllocator) allocate(s *v1.Service, used map[string]bool) net.IP {
+	for _, pool := range a.servicePools(s) {
+		for ip := pool.First; bytes.Compare(ip, pool.Last) <= 0; ip = nextIP(ip) {
+			if !used[ip.String()] {
+				return ip
+			}
+			if bytes.Equal(ip, pool.Last) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Allocate checks the allocations of services and allocates IPs for the ones
+// that need it. Allocations of older services are preserved in case of
+// conflict. It returns the list of services, with the updated objects for the
+// ones that have been allocated a new IP.
+func (a *IPAllocator) Allocate(services []*v1.Service) []*v1.Service {
+	sorted := make([]*v1.Service, len(services))
+	copy(sorted, services)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ci, cj := sorted[i].CreationTimestamp, sorted[j].CreationTimestamp
+		if !ci.Equal(cj) {
+			return ci.Before(cj)
+		}
+		if sorted[i].Namespace != sorted[j].Namespace {
+			return sorted[i].Namespace < sorted[j].Namespace
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	used := make(map[string]bool)
+	for _, ip := range defaultLBIPs() {
+		used[ip.String()] = true
+	}
+	for _, s := range sorted {
+		if s.Spec.Type == v1.ServiceTypeLoadBalancer && s.Spec.LoadBalancerIP != "" {
+			if ip := net.ParseIP(s.Spec.LoadBalancerIP); ip != nil {
+				used[ip.String()] = true
+			}
+		}
+	}
+
+	var pending []*v1.Service
+	for _, s := range sorted {
+		if !needsAllocatedIP(s) {
+			continue
+		}
+		ip := net.ParseIP(s.Annotations[AllocatedIPAnnotation])
+		if ip != nil && a.inServicePools(s, ip) && !used[ip.String()] {
+			used[ip.String()] = true
+			continue
+		}
+		pending = append(pending, s)
+	}
+
+	updated := make(map[*v1.Service]*v1.Service)
+	for _, s := range pending {
+		ip := a.allocate(s, used)
+		if ip == nil {
+			a.warn(s, "IPAllocationFailed", "Couldn't allocate IP for %s in %s, no free IPs in pools", s.Name, s.Namespace)
+			updated[s] = withoutAllocatedIP(s)
+			continue
+		}
+		used[ip.String()] = true
+		patched, err := a.patch(s, ip.String())
+		if err != nil {
+			a.warn(s, "IPAllocationFailed", "Couldn't store IP %s allocated for %s in %s: %s", ip, s.Name, s.Namespace, err)
+			updated[s] = withoutAllocatedIP(s)
+			continue
+		}
+		updated[s] = patched
+	}
+
+	result := make([]*v1.Service, len(services))
+	for i, s := range services {
+		if patched, found := updated[s]; found {
+			result[i] = patched
+		} else {
+			result[i] = s
+		}
+	}
+	return result
+}
+
+// withoutAllocatedIP returns a copy of a service without a previously
+// allocated IP, for services whose allocation is not valid anymore
+func withoutAllocatedIP(s *v1.Service) *v1.Service {
+	if _, found := s.Annotations[AllocatedIPAnnotation]; !found {
+		return s
+	}
+	copied := *s
+	copied.Annotations = make(map[string]string, len(s.Annotations))
+	for key, value := range s.Annotations {
+		if key != AllocatedIPAnnotation {
+			copied.Annotations[key] = value
+		}
+	}
+	return &copied
+}
+
+func (a *IPAllocator) warn(s *v1.Service, reason, format string, args ...interface{}) {
+	if a.warnf != nil {
+		a.warnf(s, reason, format, args...)
+	}
+}
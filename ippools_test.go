@@ -0,0 +1,159 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestParseIPPools(t *testing.T) {
+	cases := []struct {
+		pools    string
+		expected []string
+		err      bool
+	}{
+		{"", nil, false},
+		{"10.0.0.0/30", []string{"10.0.0.1-10.0.0.2"}, false},
+		{"10.0.0.8/31", []string{"10.0.0.8-10.0.0.9"}, false},
+		{"10.0.0.5/32", []string{"10.0.0.5-10.0.0.5"}, false},
+		{"10.0.0.10-10.0.0.20, team=192.168.0.0/24", []string{"10.0.0.10-10.0.0.20", "team=192.168.0.1-192.168.0.254"}, false},
+		{"fd00::/126", []string{"fd00::1-fd00::3"}, false},
+		{"fd00::10-fd00::20", []string{"fd00::10-fd00::20"}, false},
+		{"10.0.0.20-10.0.0.10", nil, true},
+		{"10.0.0.10-fd00::20", nil, true},
+		{"10.0.0.0/33", nil, true},
+		{"10.0.0.1", nil, true},
+	}
+
+	for _, c := range cases {
+		pools, err := parseIPPools(c.pools)
+		if c.err {
+			assert.Error(t, err, c.pools)
+			continue
+		}
+		if !assert.NoError(t, err, c.pools) {
+			continue
+		}
+		var found []string
+		for _, pool := range pools {
+			found = append(found, pool.String())
+		}
+		assert.Equal(t, c.expected, found, c.pools)
+	}
+}
+
+func poolService(name, namespace string, age time.Duration, lbIP, allocated string) *v1.Service {
+	s := &v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:              name,
+			Namespace:         namespace,
+			CreationTimestamp: meta_v1.NewTime(time.Now().Add(-age)),
+			Annotations:       map[string]string{},
+		},
+		Spec: v1.ServiceSpec{
+			Type:           v1.ServiceTypeLoadBalancer,
+			LoadBalancerIP: lbIP,
+		},
+	}
+	if allocated != "" {
+		s.Annotations[AllocatedIPAnnotation] = allocated
+	}
+	return s
+}
+
+func TestIPAllocator(t *testing.T) {
+	pools, err := parseIPPools("10.0.0.1-10.0.0.4,team=10.1.0.1-10.1.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patched := make(map[string]string)
+	var warnings []string
+	allocator := &IPAllocator{
+		pools: pools,
+		patch: func(s *v1.Service, ip string) (*v1.Service, error) {
+			if s.Name == "readonly" {
+				return nil, fmt.Errorf("forbidden")
+			}
+			patched[s.Name] = ip
+			updated := poolService(s.Name, s.Namespace, 0, "", ip)
+			return updated, nil
+		},
+		warnf: func(s *v1.Service, reason, format string, args ...interface{}) {
+			warnings = append(warnings, s.Name+" "+reason)
+		},
+	}
+
+	nodePort := poolService("nodeport", "default", 10*time.Hour, "", "")
+	nodePort.Spec.Type = v1.ServiceTypeNodePort
+
+	services := []*v1.Service{
+		poolService("new", "default", time.Hour, "", ""),
+		poolService("allocated", "default", 5*time.Hour, "", "10.0.0.2"),
+		poolService("static", "default", 4*time.Hour, "10.0.0.1", ""),
+		poolService("duplicated", "default", 3*time.Hour, "", "10.0.0.2"),
+		poolService("outside", "default", 2*time.Hour, "", "10.9.0.1"),
+		poolService("team-a", "team", 5*time.Hour, "", ""),
+		poolService("team-b", "team", 4*time.Hour, "", "10.1.0.1"),
+		poolService("readonly", "other", 30*time.Minute, "", "10.9.0.2"),
+		nodePort,
+	}
+
+	// Existing allocations are kept even if there are older services
+	// waiting for an IP
+	result := allocator.Allocate(services)
+	assert.Len(t, result, len(services))
+
+	assert.Equal(t, map[string]string{
+		"duplicated": "10.0.0.3",
+		"outside":    "10.0.0.4",
+	}, patched)
+	assert.Equal(t, []string{"team-a IPAllocationFailed", "new IPAllocationFailed", "readonly IPAllocationFailed"}, warnings)
+
+	ips := make(map[string]string)
+	for _, s := range result {
+		if ip := serviceLBIPWithPools(s); ip != nil {
+			ips[s.Name] = ip.String()
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"new":        "0.0.0.0",
+		"allocated":  "10.0.0.2",
+		"static":     "10.0.0.1",
+		"duplicated": "10.0.0.3",
+		"outside":    "10.0.0.4",
+		"team-a":     "0.0.0.0",
+		"team-b":     "10.1.0.1",
+		"readonly":   "0.0.0.0",
+		"nodeport":   "0.0.0.0",
+	}, ips)
+	assert.Equal(t, "10.9.0.2", services[7].Annotations[AllocatedIPAnnotation], "original objects shouldn't be modified")
+}
+
+func serviceLBIPWithPools(s *v1.Service) net.IP {
+	oldPools := lbIPPoolsArg
+	defer func() { lbIPPoolsArg = oldPools }()
+	lbIPPoolsArg = "enabled"
+	return serviceLBIP(s)
+}
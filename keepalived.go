@@ -0,0 +1,160 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+)
+
+// LVS schedulers used for the balancing algorithms that have an equivalent,
+// weighted versions are used so weights of traffic splits are honored
+var lvsSchedulers = map[string]string{
+	"roundrobin": "wrr",
+	"leastconn":  "wlc",
+	"source":     "sh",
+}
+
+const defaultLVSScheduler = "wlc"
+
+// RealServer is a server in an LVS virtual server
+type RealServer struct {
+	IP     string
+	Port   int32
+	Weight int
+
+	// Check is the health checker for this server, nil if it is not checked
+	Check *RealServerCheck
+}
+
+// RealServerCheck describes the health checker for the real servers of a
+// service, Type is the keepalived checker to use, HTTP_GET or TCP_CHECK
+type RealServerCheck struct {
+	Type   string
+	Path   string
+	Status int
+}
+
+// virtualServerIPs returns the IPs of a port that can be used as addresses
+// of virtual servers, unspecified addresses cannot be used in LVS
+func virtualServerIPs(port PortSpec) []net.IP {
+	var ips []net.IP
+	for _, ip := range port.IPs {
+		if !ip.IsUnspecified() {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func realServerWeight(s ServiceInformation, e ServiceEndpoint) int {
+	if s.TrafficSplit != nil {
+		return e.Weight
+	}
+	return 1
+}
+
+// endpointRealServers returns the endpoints of a service as real servers of
+// the given family, endpoints without IP are ignored as LVS cannot resolve
+// names
+func endpointRealServers(s ServiceInformation, vip net.IP) []RealServer {
+	var servers []RealServer
+	for _, e := range s.Endpoints {
+		ip := net.ParseIP(e.IP)
+		if ip == nil || isIPv6(ip) != isIPv6(vip) {
+			continue
+		}
+		servers = append(servers, RealServer{
+			IP:     ip.String(),
+			Port:   e.Port,
+			Weight: realServerWeight(s, e),
+			Check:  realServerCheck(s),
+		})
+	}
+	return servers
+}
+
+// nodeRealServers returns the nodes as real servers of the node port of a
+// service, names of nodes that are not IPs are resolved in background and
+// only addresses of the family of the virtual server are used
+func nodeRealServers(s ServiceInformation, nodes []string, vip net.IP) []RealServer {
+	if s.NodePort == 0 {
+		return nil
+	}
+	var servers []RealServer
+	for _, node := range nodes {
+		addresses := []string{node}
+		if net.ParseIP(node) == nil {
+			var err error
+			addresses, err = hostResolver.Lookup(node)
+			if err != nil {
+				continue
+			}
+		}
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip == nil || isIPv6(ip) != isIPv6(vip) {
+				continue
+			}
+			servers = append(servers, RealServer{
+				IP:     ip.String(),
+				Port:   s.NodePort,
+				Weight: 1,
+				Check:  realServerCheck(s),
+			})
+			break
+		}
+	}
+	return servers
+}
+
+// lvsScheduler returns the LVS scheduler for the balancing algorithm of a
+// service
+func lvsScheduler(s ServiceInformation) string {
+	if scheduler, ok := lvsSchedulers[s.Balance]; ok {
+		return scheduler
+	}
+	return defaultLVSScheduler
+}
+
+// realServerCheck returns the health checker for the real servers of a
+// service, HTTP checks are used if the health check annotation has a path,
+// UDP and SCTP services are not checked
+func realServerCheck(s ServiceInformation) *RealServerCheck {
+	if s.Port.Protocol != "tcp" {
+		return nil
+	}
+	check := RealServerCheck{Type: "TCP_CHECK"}
+	if h := s.HealthCheck; h != nil && h.Path != "" {
+		check.Type = "HTTP_GET"
+		check.Path = h.Path
+		check.Status = h.ExpectedStatus
+		if check.Status == 0 {
+			check.Status = 200
+		}
+	}
+	return &check
+}
+
+// delayLoop returns the interval between health checks of a service in
+// seconds, as used by keepalived
+func delayLoop(s ServiceInformation) int {
+	if s.HealthCheck == nil || s.HealthCheck.Interval == 0 {
+		return 5
+	}
+	// Round up, keepalived doesn't support intervals under a second
+	return (s.HealthCheck.Interval + 999) / 1000
+}
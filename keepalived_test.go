@@ -0,0 +1,188 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testLookupHost(host string) ([]string, error) {
+	switch host {
+	case "node2":
+		return []string{"10.2.0.2", "fd02::2"}, nil
+	}
+	return nil, fmt.Errorf("unknown host %s", host)
+}
+
+// useTestResolver replaces the resolver with one with the test nodes already
+// resolved, it returns a function to restore the original one
+func useTestResolver() func() {
+	oldResolver := hostResolver
+	hostResolver = NewResolver(testLookupHost)
+	hostResolver.Resolve("node2")
+	hostResolver.Resolve("unknown")
+	return func() { hostResolver = oldResolver }
+}
+
+func testKeepalivedClusterInformation() *ClusterInformation {
+	dns := ServiceInformation{
+		Name:      "dns",
+		Namespace: "kube-system",
+		PortName:  "dns",
+		Port: PortSpec{
+			IP:       net.ParseIP("10.0.0.10"),
+			IPs:      []net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("fd00::10")},
+			Port:     53,
+			Protocol: "udp",
+		},
+		Endpoints: []ServiceEndpoint{
+			{Name: "dns-1", IP: "10.1.0.1", Port: 53},
+			{Name: "dns-2", IP: "10.1.0.2", Port: 53},
+			{Name: "dns-3", IP: "fd01::1", Port: 53},
+		},
+		NodePort:        30053,
+		SessionAffinity: &SessionAffinityInformation{ClientIP: true, Timeout: defaultSessionAffinityTimeout},
+	}
+	mysql := ServiceInformation{
+		Name:      "mysql",
+		Namespace: "test",
+		PortName:  "mysql",
+		Port: PortSpec{
+			IP:       net.ParseIP("10.0.0.11"),
+			IPs:      []net.IP{net.ParseIP("10.0.0.11")},
+			Port:     3306,
+			Mode:     "tcp",
+			Protocol: "tcp",
+		},
+		Endpoints: []ServiceEndpoint{
+			{Name: "mysql-1", IP: "10.1.0.3", Port: 3306},
+			{Name: "db.example.com", Hostname: "db.example.com", Port: 3306},
+		},
+		NodePort:    30306,
+		Balance:     "roundrobin",
+		HealthCheck: &HealthCheck{Interval: 2500},
+	}
+	web := ServiceInformation{
+		Name:      "web",
+		Namespace: "test",
+		PortName:  "https",
+		Port: PortSpec{
+			IP:       net.ParseIP("10.0.0.12"),
+			IPs:      []net.IP{net.ParseIP("10.0.0.12")},
+			Port:     443,
+			Mode:     "tcp",
+			Protocol: "tcp",
+		},
+		Endpoints: []ServiceEndpoint{
+			{Name: "web-1", IP: "10.1.0.4", Port: 8443, Weight: 192},
+			{Name: "web-canary-1", IP: "10.1.0.5", Port: 8443, Weight: 64},
+		},
+		NodePort:     30443,
+		Balance:      "source",
+		HealthCheck:  &HealthCheck{Path: "/healthz"},
+		TrafficSplit: &TrafficSplitInformation{Group: "web"},
+	}
+	http := ServiceInformation{
+		Name:      "http",
+		Namespace: "test",
+		PortName:  "http",
+		Port: PortSpec{
+			IP:       net.IPv4zero,
+			IPs:      []net.IP{net.IPv4zero},
+			Port:     80,
+			Mode:     "http",
+			Protocol: "tcp",
+		},
+		Endpoints: []ServiceEndpoint{{Name: "http-1", IP: "10.1.0.6", Port: 8080}},
+		NodePort:  30080,
+	}
+	return &ClusterInformation{
+		Services: []ServiceInformation{dns, mysql, web, http},
+		Ports:    []PortSpec{dns.Port, mysql.Port, web.Port, http.Port},
+		Nodes:    []string{"10.2.0.1", "node2", "unknown"},
+		Domain:   "cluster.local",
+	}
+}
+
+func TestKeepalivedTemplate(t *testing.T) {
+	defer useTestResolver()()
+
+	source, err := ioutil.ReadFile("examples/keepalived/keepalived.conf.tpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		golden       string
+		useNodePorts bool
+	}{
+		{"testdata/keepalived-endpoints.conf", false},
+		{"testdata/keepalived-nodeports.conf", true},
+	}
+
+	for _, c := range cases {
+		templateSource := string(source)
+		if c.useNodePorts {
+			templateSource = strings.Replace(templateSource, "$useNodePorts := false", "$useNodePorts := true", 1)
+		}
+		assertGolden(t, templateSource, testKeepalivedClusterInformation(), c.golden)
+	}
+}
+
+func TestKeepalivedHelpers(t *testing.T) {
+	defer useTestResolver()()
+
+	info := testKeepalivedClusterInformation()
+	dns, mysql, web, http := info.Services[0], info.Services[1], info.Services[2], info.Services[3]
+
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("fd00::10")}, virtualServerIPs(dns.Port))
+	assert.Empty(t, virtualServerIPs(http.Port))
+
+	assert.Equal(t, []RealServer{{IP: "fd01::1", Port: 53, Weight: 1}}, endpointRealServers(dns, net.ParseIP("fd00::10")))
+	assert.Equal(t, []RealServer{
+		{IP: "10.2.0.1", Port: 30053, Weight: 1},
+		{IP: "10.2.0.2", Port: 30053, Weight: 1},
+	}, nodeRealServers(dns, info.Nodes, net.ParseIP("10.0.0.10")))
+	assert.Equal(t, []RealServer{
+		{IP: "fd02::2", Port: 30053, Weight: 1},
+	}, nodeRealServers(dns, info.Nodes, net.ParseIP("fd00::10")))
+
+	mysqlServers := endpointRealServers(mysql, mysql.Port.IP)
+	if assert.Len(t, mysqlServers, 1, "endpoints without IP should be ignored") {
+		assert.Equal(t, &RealServerCheck{Type: "TCP_CHECK"}, mysqlServers[0].Check)
+	}
+
+	webServers := endpointRealServers(web, web.Port.IP)
+	if assert.Len(t, webServers, 2) {
+		assert.Equal(t, 192, webServers[0].Weight)
+		assert.Equal(t, 64, webServers[1].Weight)
+		assert.Equal(t, &RealServerCheck{Type: "HTTP_GET", Path: "/healthz", Status: 200}, webServers[0].Check)
+	}
+
+	assert.Equal(t, "wlc", lvsScheduler(dns))
+	assert.Equal(t, "wrr", lvsScheduler(mysql))
+	assert.Equal(t, "sh", lvsScheduler(web))
+
+	assert.Equal(t, 5, delayLoop(dns))
+	assert.Equal(t, 3, delayLoop(mysql))
+}
@@ -33,7 +33,7 @@ func main() {
 	flag.StringVar(&kubecfg, "kubecfg", "", "Path to kubernetes client configuration (Optional)")
 	flag.StringVar(&domain, "domain", "local", "DNS domain for the cluster")
 	flag.StringVar(&configPath, "config", "", "Configuration path to generate")
-	flag.StringVar(&templatePath, "template", "", "Configuration source template")
+	flag.StringVar(&templatePath, "template", "", "Configuration source template, it can be a file, a directory, a glob pattern or a config map key as configmap:NAMESPACE/NAME/KEY")
 	flag.StringVar(&notify, "notify", "", "Notification configuration")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
 	flag.Parse()
@@ -43,36 +43,79 @@ func main() {
 		os.Exit(0)
 	}
 
-	if _, err := os.Stat(templatePath); err != nil {
-		log.Fatalf("Template not defined or doesn't exist")
+	// Templates are optional if resources are served with xDS
+	useTemplate := templatePath != "" || xdsServerAddress == ""
+
+	var notifier Notifier
+	var configMapSource *ConfigMapKey
+	if useTemplate {
+		if templatePath == "" {
+			log.Fatalf("Template not defined")
+		}
+		var err error
+		configMapSource, err = parseConfigMapTemplateSource(templatePath)
+		if err != nil {
+			log.Fatalf("Invalid template: %s", err)
+		}
+		if configMapSource == nil {
+			files, err := templateSources(templatePath)
+			if err != nil {
+				log.Fatalf("Couldn't find template: %s", err)
+			}
+			if _, err := templateEntryName(files, templateEntry); err != nil {
+				log.Fatalf("Couldn't find template: %s", err)
+			}
+		}
+
+		if notify == "" {
+			log.Fatalf("Notifier cannot be empty")
+		}
+
+		if f, err := os.OpenFile(configPath, os.O_WRONLY|os.O_CREATE, 0644); err != nil {
+			log.Fatalf("Cannot open configuration file to write: %v", err)
+		} else {
+			f.Close()
+		}
+
+		notifier, err = NewNotifier(notify)
+		if err != nil {
+			log.Fatalf("Couldn't initialize notifier: %s", err)
+		}
 	}
 
-	if notify == "" {
-		log.Fatalf("Notifier cannot be empty")
+	client, err := NewKubernetesClient(kubecfg, apiserver, domain)
+	if err != nil {
+		log.Fatalf("Couldn't connect with Kubernetes API server: %s", err)
 	}
 
-	if f, err := os.OpenFile(configPath, os.O_WRONLY|os.O_CREATE, 0644); err != nil {
-		log.Fatalf("Cannot open configuration file to write: %v", err)
-	} else {
-		f.Close()
+	if err := initServerNameTemplates(); err != nil {
+		log.Fatalf("Couldn't initialize server name templates: %s", err)
 	}
 
-	notifier, err := NewNotifier(notify)
-	if err != nil {
-		log.Fatalf("Couldn't initialize notifier: %s", err)
+	if err := initSanityChecks(); err != nil {
+		log.Fatalf("Couldn't initialize sanity checks: %s", err)
 	}
 
-	client, err := NewKubernetesClient(kubecfg, apiserver, domain)
-	if err != nil {
-		log.Fatalf("Couldn't connect with Kubernetes API server: %s", err)
+	if metricsAddress != "" {
+		go serveMetrics(metricsAddress)
 	}
 
-	if err := initServerNameTemplates(); err != nil {
-		log.Fatalf("Couldn't initialize server name templates: %s", err)
+	if xdsServerAddress != "" {
+		xds := NewXDSServer()
+		go xds.Serve(xdsServerAddress)
+		client.AddTemplate(xds)
 	}
 
-	client.AddTemplate(NewTemplate(templatePath, configPath))
-	client.AddNotifier(notifier)
+	if useTemplate {
+		if configMapSource != nil {
+			if err := client.AddConfigMapTemplate(*configMapSource, configPath); err != nil {
+				log.Fatalf("Couldn't use template from config map: %s", err)
+			}
+		} else {
+			client.AddTemplate(NewTemplate(templatePath, configPath))
+		}
+		client.AddNotifier(notifier)
+	}
 
 	if err := client.Watch(context.Background()); err != nil {
 		log.Fatalf("Couldn't watch Kubernetes API server: %s", err)
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,6 +32,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	core_v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/pkg/api"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/rest"
@@ -42,8 +44,8 @@ var defaultPortMode = "http"
 var reconnectTimeoutSeconds = 300
 
 func init() {
-	flag.StringVar(&defaultLBIP, "default-lb-ip", defaultLBIP, "Default IP for services in load balancer, can be overriden by loadBalancerIP service field")
-	flag.StringVar(&defaultPortMode, "default-port-mode", defaultPortMode, "Default mode for service ports")
+	flag.StringVar(&defaultLBIP, "default-lb-ip", defaultLBIP, "Default IP for services in load balancer, can be overriden by loadBalancerIP service field. A comma-separated list can be used for dual-stack services")
+	flag.StringVar(&defaultPortMode, "default-port-mode", defaultPortMode, "Default mode for TCP service ports, http or tcp")
 	flag.IntVar(&reconnectTimeoutSeconds, "reconnect-timeout", reconnectTimeoutSeconds, "Reconnect timeout in seconds")
 }
 
@@ -54,10 +56,19 @@ type KubernetesClient struct {
 	nodeStore      NodeStore
 	serviceStore   ServiceStore
 	endpointsStore EndpointsStore
+	ingressStore   IngressStore
+	secretStore    SecretStore
+	configMapStore ConfigMapStore
 
 	nodeWatcher      watch.Interface
 	serviceWatcher   watch.Interface
 	endpointsWatcher watch.Interface
+	ingressWatcher   watch.Interface
+	secretWatcher    watch.Interface
+	configMapWatcher watch.Interface
+
+	// configMapSource is the config map used as template, if any
+	configMapSource *ConfigMapKey
 
 	lastResourceVersion string
 
@@ -67,6 +78,11 @@ type KubernetesClient struct {
 	notifiers []Notifier
 	templates []Template
 
+	certificates *CertificatesWriter
+	acme         *ACMEManager
+	events       *EventRecorder
+	ipAllocator  *IPAllocator
+
 	domain string
 }
 
@@ -74,6 +90,18 @@ const (
 	ExternalDomainsAnnotation = "kube2lb/external-domains"
 	PortModeAnnotation        = "kube2lb/port-mode"
 	BackendTimeoutAnnotation  = "kube2lb/backend-timeout"
+	ExposeAnnotation          = "kube2lb/expose"
+	PathsAnnotation           = "kube2lb/paths"
+	TLSSecretAnnotation       = "kube2lb/tls-secret"
+	ACMEAnnotation            = "kube2lb/acme"
+	BalanceAnnotation         = "kube2lb/balance"
+	MaxConnectionsAnnotation  = "kube2lb/max-connections"
+	HealthCheckAnnotation     = "kube2lb/health-check"
+	StickyCookieAnnotation    = "kube2lb/sticky-cookie"
+	TrafficSplitAnnotation    = "kube2lb/traffic-split"
+	AllocatedIPAnnotation     = "kube2lb/allocated-ip"
+
+	ExternalNameResolutionAnnotation = "kube2lb/external-name-resolution"
 )
 
 func NewKubernetesClient(kubecfg, apiserver, domain string) (*KubernetesClient, error) {
@@ -96,6 +124,37 @@ func NewKubernetesClient(kubecfg, apiserver, domain string) (*KubernetesClient,
 		updaterBuilder: NewUpdater,
 	}
 
+	if tlsDir != "" {
+		kc.certificates, err = NewCertificatesWriter(tlsDir)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't initialize certificates directory: %v", err)
+		}
+	}
+
+	if recordEvents {
+		kc.events = NewEventRecorder(clientset.Core())
+	}
+
+	if lbIPPoolsArg != "" {
+		pools, err := parseIPPools(lbIPPoolsArg)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse IP pools: %v", err)
+		}
+		kc.ipAllocator = NewIPAllocator(pools, clientset.Core())
+		kc.ipAllocator.warnf = kc.serviceWarningf
+	}
+
+	if acmeDirectoryURL != "" {
+		var secrets core_v1.SecretInterface
+		if acmeSecretsNamespace != "" {
+			secrets = clientset.Core().Secrets(acmeSecretsNamespace)
+		}
+		kc.acme, err = NewACMEManager(acmeDirectoryURL, acmeDir, acmeEmail, acmeCABundle, acmeAcceptTOS, secrets)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't initialize ACME: %v", err)
+		}
+	}
+
 	if err := kc.connect(); err != nil {
 		return nil, err
 	}
@@ -132,9 +191,42 @@ func (c *KubernetesClient) connect() (err error) {
 	if err != nil {
 		return fmt.Errorf("couldn't watch events on endpoints: %v", err)
 	}
+
+	if watchIngresses {
+		ii := c.clientset.Extensions().Ingresses(api.NamespaceAll)
+		c.ingressWatcher, err = ii.Watch(options)
+		if err != nil {
+			return fmt.Errorf("couldn't watch events on ingresses: %v", err)
+		}
+	}
+
+	if tlsDir != "" {
+		secretOptions := options
+		secretOptions.FieldSelector = fmt.Sprintf("type=%s", v1.SecretTypeTLS)
+		si := c.clientset.Core().Secrets(api.NamespaceAll)
+		c.secretWatcher, err = si.Watch(secretOptions)
+		if err != nil {
+			return fmt.Errorf("couldn't watch events on secrets: %v", err)
+		}
+	}
+
+	if c.configMapSource != nil {
+		err = c.watchConfigMap(options)
+	}
 	return
 }
 
+// watchConfigMap watches the config map used as template
+func (c *KubernetesClient) watchConfigMap(options meta_v1.ListOptions) (err error) {
+	options.FieldSelector = fmt.Sprintf("metadata.name=%s", c.configMapSource.Name)
+	ci := c.clientset.Core().ConfigMaps(c.configMapSource.Namespace)
+	c.configMapWatcher, err = ci.Watch(options)
+	if err != nil {
+		return fmt.Errorf("couldn't watch events on config maps: %v", err)
+	}
+	return nil
+}
+
 func (c *KubernetesClient) stopWatchers() {
 	if c.nodeWatcher != nil {
 		c.nodeWatcher.Stop()
@@ -145,6 +237,24 @@ func (c *KubernetesClient) stopWatchers() {
 	if c.endpointsWatcher != nil {
 		c.endpointsWatcher.Stop()
 	}
+	if c.ingressWatcher != nil {
+		c.ingressWatcher.Stop()
+	}
+	if c.secretWatcher != nil {
+		c.secretWatcher.Stop()
+	}
+	if c.configMapWatcher != nil {
+		c.configMapWatcher.Stop()
+	}
+}
+
+// resultChan returns the channel of a watcher, or nil if the watcher is
+// not set, so it can be used in select statements for optional resources
+func resultChan(w watch.Interface) <-chan watch.Event {
+	if w == nil {
+		return nil
+	}
+	return w.ResultChan()
 }
 
 func (c *KubernetesClient) AddNotifier(n Notifier) {
@@ -163,6 +273,28 @@ func (c *KubernetesClient) AddTemplate(t Template) {
 	c.templates = append(c.templates, t)
 }
 
+// AddConfigMapTemplate adds a template whose source is a key in a config
+// map, the config map is watched so changes in the template are applied
+func (c *KubernetesClient) AddConfigMapTemplate(source ConfigMapKey, path string) error {
+	if c.configMapSource != nil {
+		return fmt.Errorf("only one config map template can be used")
+	}
+	c.configMapSource = &source
+	if err := c.watchConfigMap(meta_v1.ListOptions{ResourceVersion: c.lastResourceVersion}); err != nil {
+		c.configMapSource = nil
+		return err
+	}
+	c.AddTemplate(&configMapTemplate{
+		Source: source,
+		Path:   path,
+		getConfigMap: func(namespace, name string) (*v1.ConfigMap, error) {
+			return c.configMapStore.Get(namespace, name)
+		},
+		warnf: c.configMapWarningf,
+	})
+	return nil
+}
+
 func (c *KubernetesClient) ExecuteTemplates(info *ClusterInformation) {
 	for _, t := range c.templates {
 		if err := t.Execute(info); err != nil {
@@ -171,14 +303,132 @@ func (c *KubernetesClient) ExecuteTemplates(info *ClusterInformation) {
 	}
 }
 
-func (c *KubernetesClient) readAnnotation(meta meta_v1.ObjectMeta, annotation string, value interface{}) {
-	data, ok := meta.Annotations[annotation]
+// tlsInformation writes the certificate of a TLS secret to the certificates
+// directory and returns the information about it
+func (c *KubernetesClient) tlsInformation(namespace, secretName string) (*TLSInformation, error) {
+	if c.certificates == nil {
+		return nil, fmt.Errorf("secrets are not being watched, a directory for certificates is needed")
+	}
+	secret, err := c.secretStore.Get(namespace, secretName)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("secret %s not found in %s", secretName, namespace)
+	}
+	return c.certificates.Write(secret)
+}
+
+func (c *KubernetesClient) readAnnotation(s *v1.Service, annotation string, value interface{}) {
+	data, ok := s.ObjectMeta.Annotations[annotation]
 	if ok && len(data) > 0 {
 		err := json.Unmarshal([]byte(data), value)
 		if err != nil {
-			log.Printf("Couldn't parse %s annotation for %s service: %s", annotation, meta.Name, err)
+			c.serviceWarningf(s, "InvalidAnnotation", "Couldn't parse %s annotation for %s service: %s", annotation, s.Name, err)
+		}
+	}
+}
+
+// isExposed decides if a service has to be included in the load balancer
+// configuration, by default only services of types NodePort and LoadBalancer
+// are exposed, but this can be overriden with an annotation. Invalid values of
+// the annotation are reported
+func (c *KubernetesClient) isExposed(s *v1.Service) bool {
+	if value, ok := s.ObjectMeta.Annotations[ExposeAnnotation]; ok && len(value) > 0 {
+		expose, err := strconv.ParseBool(value)
+		if err == nil {
+			return expose
+		}
+		c.serviceWarningf(s, "InvalidAnnotation", "Couldn't parse %s annotation for %s service: %s", ExposeAnnotation, s.Name, err)
+	}
+
+	switch s.Spec.Type {
+	case v1.ServiceTypeNodePort, v1.ServiceTypeLoadBalancer:
+		return true
+	}
+	return false
+}
+
+// acmeRequested decides if certificates have to be obtained with ACME for a
+// service, invalid values of the annotation are reported
+func (c *KubernetesClient) acmeRequested(s *v1.Service) bool {
+	value, ok := s.ObjectMeta.Annotations[ACMEAnnotation]
+	if !ok || len(value) == 0 {
+		return false
+	}
+	requested, err := strconv.ParseBool(value)
+	if err != nil {
+		c.serviceWarningf(s, "InvalidAnnotation", "Couldn't parse %s annotation for %s service: %s", ACMEAnnotation, s.Name, err)
+		return false
+	}
+	return requested
+}
+
+// exposedServices returns the services that have to be included in the load
+// balancer configuration
+func (c *KubernetesClient) exposedServices(services []*v1.Service) []*v1.Service {
+	exposed := make([]*v1.Service, 0, len(services))
+	for _, s := range services {
+		if c.isExposed(s) {
+			exposed = append(exposed, s)
+		}
+	}
+	return exposed
+}
+
+// parseDefaultLBIPs parses the comma-separated list of default IPs
+func parseDefaultLBIPs(defaultLBIP string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, value := range strings.Split(defaultLBIP, ",") {
+		ip := net.ParseIP(strings.TrimSpace(value))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid default lb IP %s", value)
 		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// defaultLBIPs returns the default IPs for services, it is assumed that
+// they have been already validated
+func defaultLBIPs() []net.IP {
+	ips, _ := parseDefaultLBIPs(defaultLBIP)
+	return ips
+}
+
+// loadBalancerIP returns the IP of a LoadBalancer service, the one in its
+// spec, or the one allocated from a pool, it is empty for other services or
+// if no IP has been requested nor allocated
+func loadBalancerIP(s *v1.Service) string {
+	if s.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return ""
+	}
+	if s.Spec.LoadBalancerIP != "" {
+		return s.Spec.LoadBalancerIP
+	}
+	if lbIPPoolsArg != "" {
+		return s.Annotations[AllocatedIPAnnotation]
+	}
+	return ""
+}
+
+// serviceLBIPs returns the IPs where a service has to be exposed, LoadBalancer
+// services use the IP in their spec, or the one allocated from a pool, other
+// services use the default IPs
+func serviceLBIPs(s *v1.Service) []net.IP {
+	if ip := loadBalancerIP(s); ip != "" {
+		return []net.IP{net.ParseIP(ip)}
+	}
+	return defaultLBIPs()
+}
+
+// serviceLBIP returns the main IP where a service has to be exposed
+func serviceLBIP(s *v1.Service) net.IP {
+	ips := serviceLBIPs(s)
+	if len(ips) == 0 {
+		return nil
 	}
+	return ips[0]
 }
 
 func (c *KubernetesClient) getServices() ([]ServiceInformation, error) {
@@ -187,6 +437,12 @@ func (c *KubernetesClient) getServices() ([]ServiceInformation, error) {
 		return nil, fmt.Errorf("couldn't get services: %s", err)
 	}
 
+	// Services that are not exposed don't need IPs
+	services = c.exposedServices(services)
+	if c.ipAllocator != nil {
+		services = c.ipAllocator.Allocate(services)
+	}
+
 	endpoints, err := c.endpointsStore.List()
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get endpoints: %s", err)
@@ -196,62 +452,133 @@ func (c *KubernetesClient) getServices() ([]ServiceInformation, error) {
 
 	servicesInformation := make([]ServiceInformation, 0, len(services))
 	for _, s := range services {
-		var external []string
-		if domains, ok := s.ObjectMeta.Annotations[ExternalDomainsAnnotation]; ok && len(domains) > 0 {
-			external = strings.Split(domains, ",")
+		external, errs := ExternalDomainsValidator{}.ExternalDomains(s)
+		for _, err := range errs {
+			c.serviceWarningf(s, "InvalidExternalDomain", "Ignoring %s", err)
 		}
 
 		var portModes map[string]string
-		c.readAnnotation(s.ObjectMeta, PortModeAnnotation, &portModes)
+		c.readAnnotation(s, PortModeAnnotation, &portModes)
 
 		var backendTimeouts map[string]int
-		c.readAnnotation(s.ObjectMeta, BackendTimeoutAnnotation, &backendTimeouts)
-
-		switch s.Spec.Type {
-		case v1.ServiceTypeNodePort, v1.ServiceTypeLoadBalancer:
-			endpointsPortsMap := endpointsHelper.ServicePortsMap(s)
-			if len(endpointsPortsMap) == 0 {
-				log.Printf("Couldn't find endpoints for %s in %s?", s.Name, s.Namespace)
-				continue
+		c.readAnnotation(s, BackendTimeoutAnnotation, &backendTimeouts)
+
+		var paths map[string][]PathRule
+		c.readAnnotation(s, PathsAnnotation, &paths)
+
+		balancing := c.readBalancingAnnotations(s)
+
+		var stickyCookies map[string]string
+		c.readAnnotation(s, StickyCookieAnnotation, &stickyCookies)
+
+		var trafficSplit *TrafficSplit
+		c.readAnnotation(s, TrafficSplitAnnotation, &trafficSplit)
+		if trafficSplit != nil {
+			if err := trafficSplit.Validate(); err != nil {
+				c.serviceWarningf(s, "InvalidAnnotation", "Ignoring invalid %s annotation for %s in %s: %s", TrafficSplitAnnotation, s.Name, s.Namespace, err)
+				trafficSplit = nil
 			}
+		}
 
-			err := ValidateService(s)
+		annotations := serviceAnnotations(s.ObjectMeta)
+		labels := serviceLabels(s.ObjectMeta)
+
+		var tlsInfo *TLSInformation
+		if secretName, ok := s.ObjectMeta.Annotations[TLSSecretAnnotation]; ok && len(secretName) > 0 {
+			tlsInfo, err = c.tlsInformation(s.Namespace, secretName)
 			if err != nil {
-				log.Printf("Service validation failed: %s", err)
-				break
+				c.serviceWarningf(s, "InvalidTLS", "Couldn't configure TLS for %s in %s: %s", s.Name, s.Namespace, err)
 			}
+		} else if c.acme != nil && c.acmeRequested(s) {
+			name := fmt.Sprintf("%s_%s", s.Namespace, s.Name)
+			tlsInfo = c.acme.Certificate(name, acmeDomains(external))
+		}
 
-			parsedLBIP := net.ParseIP(defaultLBIP)
-			if s.Spec.Type == v1.ServiceTypeLoadBalancer && s.Spec.LoadBalancerIP != "" {
-				parsedLBIP = net.ParseIP(s.Spec.LoadBalancerIP)
+		var resolution string
+		isExternalName := s.Spec.Type == v1.ServiceTypeExternalName
+		if isExternalName {
+			resolution = ExternalNameResolutionDNS
+			if value, ok := s.ObjectMeta.Annotations[ExternalNameResolutionAnnotation]; ok && len(value) > 0 {
+				resolution = strings.ToLower(value)
 			}
+		}
 
-			for _, port := range s.Spec.Ports {
-				mode, ok := portModes[port.Name]
-				if !ok {
-					mode = defaultPortMode
+		endpointsPortsMap := endpointsHelper.ServicePortsMap(s)
+		if !isExternalName && endpointsPortsMap.Len() == 0 {
+			c.serviceWarningf(s, "NoEndpoints", "Couldn't find endpoints for %s in %s?", s.Name, s.Namespace)
+			continue
+		}
+
+		err := ValidateService(s)
+		if err != nil {
+			c.serviceWarningf(s, "ValidationFailed", "Service validation failed: %s", err)
+			continue
+		}
+
+		lbIPs := serviceLBIPs(s)
+
+		for _, port := range s.Spec.Ports {
+			mode, err := portMode(port.Protocol, portModes[port.Name])
+			if err != nil {
+				c.serviceWarningf(s, "InvalidAnnotation", "Ignoring %s annotation for port %s of %s in %s: %s", PortModeAnnotation, port.Name, s.Name, s.Namespace, err)
+			}
+			timeout, ok := backendTimeouts[port.Name]
+			if !ok {
+				timeout = 0
+			}
+			balance, maxConnections, healthCheck := balancing.PortBalancing(s, port.Name)
+			affinity := c.sessionAffinity(s, port.Name, mode, stickyCookies)
+			var split *TrafficSplitInformation
+			if trafficSplit != nil {
+				split = &TrafficSplitInformation{
+					Group:    trafficSplit.Group,
+					Services: []TrafficSplitService{{Name: s.Name, Weight: trafficSplit.Weight}},
 				}
-				timeout, ok := backendTimeouts[port.Name]
-				if !ok {
-					timeout = 0
+			}
+			endpoints := endpointsPortsMap.Get(port)
+			if isExternalName {
+				endpoints, err = ExternalNameEndpoints(s, port, resolution)
+				if err == errNotResolvedYet {
+					// Configuration is generated again once it is resolved
+					log.Printf("External name %s of %s in %s is not resolved yet, skipping it", s.Spec.ExternalName, s.Name, s.Namespace)
+					continue
+				}
+				if err != nil {
+					c.serviceWarningf(s, "NoEndpoints", "Couldn't get endpoints for external name %s of %s in %s: %s", s.Spec.ExternalName, s.Name, s.Namespace, err)
+					continue
 				}
-				servicesInformation = append(servicesInformation,
-					ServiceInformation{
-						Name:      s.Name,
-						Namespace: s.Namespace,
-						Port: PortSpec{
-							IP:       parsedLBIP,
-							Port:     port.Port,
-							Mode:     strings.ToLower(mode),
-							Protocol: strings.ToLower(string(port.Protocol)),
-						},
-						Endpoints: endpointsPortsMap[port.TargetPort.IntVal],
-						NodePort:  port.NodePort,
-						External:  external,
-						Timeout:   timeout,
-					},
-				)
 			}
+			servicesInformation = append(servicesInformation,
+				ServiceInformation{
+					Name:      s.Name,
+					Namespace: s.Namespace,
+					PortName:  port.Name,
+					Port: PortSpec{
+						IP:       lbIPs[0],
+						IPs:      lbIPs,
+						Port:     port.Port,
+						Mode:     mode,
+						Protocol: strings.ToLower(string(port.Protocol)),
+					},
+					Endpoints:       endpoints,
+					NodePort:        port.NodePort,
+					External:        external,
+					Timeout:         timeout,
+					Balance:         balance,
+					MaxConnections:  maxConnections,
+					HealthCheck:     healthCheck,
+					SessionAffinity: affinity,
+					TrafficSplit:    split,
+					Paths:           paths[port.Name],
+					TLS:             tlsInfo,
+					ExternalName:    s.Spec.ExternalName,
+					Resolution:      resolution,
+					Annotations:     annotations,
+					Labels:          labels,
+
+					source: s,
+				},
+			)
 		}
 	}
 	return servicesInformation, nil
@@ -260,14 +587,20 @@ func (c *KubernetesClient) getServices() ([]ServiceInformation, error) {
 func (c *KubernetesClient) Update(ctx context.Context) error {
 	nodeNames := c.nodeStore.GetNames()
 
-	if net.ParseIP(defaultLBIP) == nil {
-		return fmt.Errorf("invalid default lb IP %s", defaultLBIP)
+	if _, err := parseDefaultLBIPs(defaultLBIP); err != nil {
+		return err
+	}
+	if err := validateDefaultPortMode(defaultPortMode); err != nil {
+		return err
 	}
 
 	services, err := c.getServices()
 	if err != nil {
 		return fmt.Errorf("couldn't get services: %s", err)
 	}
+	services = mergeTrafficSplits(services)
+	services, conflicts := resolveConflicts(services, c.domain)
+	c.reportConflicts(conflicts)
 
 	portsMap := make(map[string]PortSpec)
 	for _, service := range services {
@@ -278,11 +611,32 @@ func (c *KubernetesClient) Update(ctx context.Context) error {
 		ports = append(ports, port)
 	}
 
+	var ingresses []IngressInformation
+	if watchIngresses {
+		ingresses, err = c.getIngresses()
+		if err != nil {
+			return fmt.Errorf("couldn't get ingresses: %s", err)
+		}
+	}
+
+	if c.certificates != nil {
+		c.certificates.Cleanup()
+	}
+
+	var acmeAddress string
+	if c.acme != nil {
+		c.acme.Sweep()
+		acmeAddress = acmeHTTPAddress
+	}
+
 	info := &ClusterInformation{
-		Nodes:    nodeNames,
-		Services: services,
-		Ports:    ports,
-		Domain:   c.domain,
+		Nodes:     nodeNames,
+		Services:  services,
+		Ports:     ports,
+		Ingresses: ingresses,
+		Domain:    c.domain,
+
+		ACMEHTTPAddress: acmeAddress,
 	}
 	c.ExecuteTemplates(info)
 	c.Notify(ctx)
@@ -306,11 +660,28 @@ func (c *KubernetesClient) Watch(ctx context.Context) error {
 	})
 	go updater.Run(ctx)
 
+	for _, t := range c.templates {
+		if w, ok := t.(WatchedTemplate); ok {
+			go w.Watch(ctx, updater.Signal)
+		}
+	}
+
+	hostResolver.SetNotify(updater.Signal)
+	go hostResolver.Run(ctx)
+
+	if c.acme != nil {
+		c.acme.SetNotify(updater.Signal)
+		go c.acme.Run(ctx, acmeHTTPAddress)
+	}
+
 	resetStores := func() {
 		isFirstUpdate = true
 		c.nodeStore = NodeStore{NewLocalStore()}
 		c.serviceStore = ServiceStore{NewLocalStore()}
 		c.endpointsStore = EndpointsStore{NewLocalStore()}
+		c.ingressStore = IngressStore{NewLocalStore()}
+		c.secretStore = SecretStore{NewLocalStore()}
+		c.configMapStore = ConfigMapStore{NewLocalStore()}
 		c.lastResourceVersion = ""
 	}
 	resetStores()
@@ -361,6 +732,12 @@ func (c *KubernetesClient) Watch(ctx context.Context) error {
 			updateStore(c.serviceStore, e)
 		case e, more = <-c.endpointsWatcher.ResultChan():
 			updateStore(c.endpointsStore, e)
+		case e, more = <-resultChan(c.ingressWatcher):
+			updateStore(c.ingressStore, e)
+		case e, more = <-resultChan(c.secretWatcher):
+			updateStore(c.secretStore, e)
+		case e, more = <-resultChan(c.configMapWatcher):
+			updateStore(c.configMapStore, e)
 		}
 
 		// Used in tests to know when events have been processed
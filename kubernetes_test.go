@@ -19,6 +19,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"testing"
 	"time"
 
@@ -28,6 +29,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
 )
 
 type testWatcher struct {
@@ -282,3 +284,327 @@ func TestKubernetesWatch(t *testing.T) {
 	assert.Equal(t, updater.Signaled, true, "Updater should have been signaled when adding annotation to service")
 	updater.F(ctx)
 }
+
+func TestKubernetesIngresses(t *testing.T) {
+	watchIngresses = true
+	defer func() { watchIngresses = false }()
+
+	client := &KubernetesClient{
+		serviceStore:   ServiceStore{NewLocalStore()},
+		endpointsStore: EndpointsStore{NewLocalStore()},
+		ingressStore:   IngressStore{NewLocalStore()},
+	}
+
+	client.serviceStore.Update(&v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/service/1", Name: "web", Namespace: "test"},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeClusterIP,
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)},
+			},
+		},
+	})
+	client.endpointsStore.Update(&v1.Endpoints{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/endpoints/1", Name: "web", Namespace: "test"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+				Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+			},
+		},
+	})
+
+	backend := v1beta1.IngressBackend{ServiceName: "web", ServicePort: intstr.FromString("http")}
+	client.ingressStore.Update(&v1beta1.Ingress{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/ingress/1", Name: "web", Namespace: "test"},
+		Spec: v1beta1.IngressSpec{
+			TLS: []v1beta1.IngressTLS{{Hosts: []string{"web.example.com"}, SecretName: "web-tls"}},
+			Rules: []v1beta1.IngressRule{
+				{
+					Host: "web.example.com",
+					IngressRuleValue: v1beta1.IngressRuleValue{
+						HTTP: &v1beta1.HTTPIngressRuleValue{
+							Paths: []v1beta1.HTTPIngressPath{
+								{Path: "/", Backend: backend},
+								{Path: "/missing", Backend: v1beta1.IngressBackend{ServiceName: "missing", ServicePort: intstr.FromInt(80)}},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	client.ingressStore.Update(&v1beta1.Ingress{
+		ObjectMeta: meta_v1.ObjectMeta{
+			SelfLink:    "/ingress/2",
+			Name:        "other",
+			Namespace:   "test",
+			Annotations: map[string]string{IngressClassAnnotation: "other"},
+		},
+		Spec: v1beta1.IngressSpec{Backend: &backend},
+	})
+
+	ingresses, err := client.getIngresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 1, len(ingresses), "ingresses of other classes should be ignored") {
+		ingress := ingresses[0]
+		assert.Equal(t, "web", ingress.Name)
+		assert.Nil(t, ingress.DefaultBackend)
+		if assert.Equal(t, 1, len(ingress.Rules)) {
+			assert.Equal(t, "web.example.com", ingress.Rules[0].Host)
+			if assert.Equal(t, 1, len(ingress.Rules[0].Paths), "paths with unknown services should be skipped") {
+				path := ingress.Rules[0].Paths[0]
+				assert.Equal(t, "/", path.Path)
+				assert.Equal(t, int32(80), path.Backend.Port)
+				if assert.Equal(t, 1, len(path.Backend.Endpoints)) {
+					assert.Equal(t, "10.0.0.1:8080", path.Backend.Endpoints[0].String())
+				}
+			}
+		}
+		if assert.Equal(t, 1, len(ingress.TLS)) {
+			assert.Equal(t, "web-tls", ingress.TLS[0].SecretName)
+		}
+	}
+}
+
+func TestIngressRoutes(t *testing.T) {
+	backend := func(name string) IngressBackendInformation {
+		return IngressBackendInformation{Service: name, Namespace: "test", Port: 80}
+	}
+	ingresses := []IngressInformation{
+		{Rules: []IngressRuleInformation{
+			{Host: "", Paths: []IngressPathInformation{{Path: "/api/users", Backend: backend("any-users")}}},
+			{Host: "example.com", Paths: []IngressPathInformation{{Path: "/", Backend: backend("web")}}},
+		}},
+		{Rules: []IngressRuleInformation{
+			{Host: "example.com", Paths: []IngressPathInformation{
+				{Path: "", Backend: backend("default")},
+				{Path: "/api", Backend: backend("api")},
+			}},
+		}},
+	}
+
+	var routes []string
+	for _, r := range ingressRoutes(ingresses) {
+		routes = append(routes, r.Host+r.Path+" "+r.Backend.Service)
+	}
+	expected := []string{
+		"example.com/api api",
+		"example.com/ web",
+		"example.com default",
+		"/api/users any-users",
+	}
+	assert.Equal(t, expected, routes)
+}
+
+func TestIsExposed(t *testing.T) {
+	cases := []struct {
+		serviceType v1.ServiceType
+		annotation  string
+		expected    bool
+	}{
+		{v1.ServiceTypeNodePort, "", true},
+		{v1.ServiceTypeLoadBalancer, "", true},
+		{v1.ServiceTypeClusterIP, "", false},
+		{v1.ServiceTypeClusterIP, "true", true},
+		{v1.ServiceTypeClusterIP, "foo", false},
+		{v1.ServiceTypeNodePort, "false", false},
+		{v1.ServiceTypeNodePort, "foo", true},
+	}
+
+	client := &KubernetesClient{}
+	for _, c := range cases {
+		s := &v1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "service1", Namespace: "test"},
+			Spec:       v1.ServiceSpec{Type: c.serviceType},
+		}
+		if c.annotation != "" {
+			s.ObjectMeta.Annotations = map[string]string{ExposeAnnotation: c.annotation}
+		}
+		assert.Equal(t, c.expected, client.isExposed(s), "service of type %s with annotation '%s'", c.serviceType, c.annotation)
+	}
+
+	events := newTestEvents()
+	client = &KubernetesClient{events: NewEventRecorder(events)}
+	invalid := &v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "invalid", Namespace: "test", Annotations: map[string]string{ExposeAnnotation: "foo"}},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeNodePort},
+	}
+	assert.True(t, client.isExposed(invalid))
+	assert.Equal(t, "InvalidAnnotation", events.Wait(t).Reason, "invalid annotations should be reported")
+
+	hidden := &v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "hidden", Namespace: "test", Annotations: map[string]string{ExposeAnnotation: "false"}},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	exposed := &v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "exposed", Namespace: "test"},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	assert.Equal(t, []*v1.Service{exposed}, client.exposedServices([]*v1.Service{hidden, exposed}), "hidden services shouldn't be allocated IPs")
+}
+
+func TestKubernetesExternalNameAndManualEndpoints(t *testing.T) {
+	oldResolver := hostResolver
+	defer func() { hostResolver = oldResolver }()
+	hostResolver = NewResolver(func(host string) ([]string, error) {
+		if host != "legacy.example.com" {
+			return nil, fmt.Errorf("unknown host %s", host)
+		}
+		return []string{"192.168.0.2", "192.168.0.1"}, nil
+	})
+	hostResolver.Resolve("legacy.example.com")
+
+	client := &KubernetesClient{
+		serviceStore:   ServiceStore{NewLocalStore()},
+		endpointsStore: EndpointsStore{NewLocalStore()},
+	}
+
+	exposed := map[string]string{ExposeAnnotation: "true"}
+	client.serviceStore.Update(&v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/service/1", Name: "external-dns", Namespace: "test", Annotations: exposed},
+		Spec: v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: "legacy.example.com",
+			Ports:        []v1.ServicePort{{Name: "http", Port: 80}},
+		},
+	})
+	client.serviceStore.Update(&v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			SelfLink:  "/service/2",
+			Name:      "external-static",
+			Namespace: "test",
+			Annotations: map[string]string{
+				ExposeAnnotation:                 "true",
+				ExternalNameResolutionAnnotation: "static",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: "legacy.example.com",
+			Ports:        []v1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)}},
+		},
+	})
+	client.serviceStore.Update(&v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/service/3", Name: "manual", Namespace: "test"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(80)}},
+		},
+	})
+	client.endpointsStore.Update(&v1.Endpoints{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/endpoints/3", Name: "manual", Namespace: "test"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{{IP: "192.168.1.1"}},
+				Ports:     []v1.EndpointPort{{Port: 8000}},
+			},
+			{
+				Addresses: []v1.EndpointAddress{{IP: "192.168.1.2"}},
+				Ports:     []v1.EndpointPort{{Port: 8001}},
+			},
+		},
+	})
+
+	services, err := client.getServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	servicesMap := make(map[string]ServiceInformation)
+	for _, service := range services {
+		servicesMap[service.Name] = service
+	}
+	if !assert.Equal(t, 3, len(servicesMap)) {
+		t.FailNow()
+	}
+
+	service := servicesMap["external-dns"]
+	assert.Equal(t, ExternalNameResolutionDNS, service.Resolution)
+	if assert.Equal(t, 1, len(service.Endpoints)) {
+		assert.Equal(t, "legacy.example.com:80", service.Endpoints[0].String())
+	}
+
+	service = servicesMap["external-static"]
+	assert.Equal(t, ExternalNameResolutionStatic, service.Resolution)
+	if assert.Equal(t, 2, len(service.Endpoints)) {
+		assert.Equal(t, "192.168.0.1:8080", service.Endpoints[0].String())
+		assert.Equal(t, "192.168.0.2:8080", service.Endpoints[1].String())
+	}
+
+	service = servicesMap["manual"]
+	assert.Equal(t, "", service.Resolution)
+	assert.Equal(t, 2, len(service.Endpoints), "endpoints of all subsets expected")
+}
+
+func TestKubernetesIPv6(t *testing.T) {
+	oldDefaultLBIP := defaultLBIP
+	defer func() { defaultLBIP = oldDefaultLBIP }()
+
+	client := &KubernetesClient{
+		serviceStore:   ServiceStore{NewLocalStore()},
+		endpointsStore: EndpointsStore{NewLocalStore()},
+	}
+
+	client.serviceStore.Update(&v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/service/1", Name: "web", Namespace: "test"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{{Name: "http", Port: 80}},
+		},
+	})
+	client.serviceStore.Update(&v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/service/2", Name: "lb", Namespace: "test"},
+		Spec: v1.ServiceSpec{
+			Type:           v1.ServiceTypeLoadBalancer,
+			LoadBalancerIP: "fd00::80",
+			Ports:          []v1.ServicePort{{Name: "http", Port: 80}},
+		},
+	})
+	for i, name := range []string{"web", "lb"} {
+		client.endpointsStore.Update(&v1.Endpoints{
+			ObjectMeta: meta_v1.ObjectMeta{SelfLink: fmt.Sprintf("/endpoints/%d", i), Name: name, Namespace: "test"},
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{{IP: "fd00:10::1"}},
+					Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+				},
+			},
+		})
+	}
+
+	cases := []struct {
+		defaultLBIP string
+		webIPs      []net.IP
+	}{
+		{"::", []net.IP{net.IPv6zero}},
+		{"0.0.0.0, ::", []net.IP{net.IPv4zero, net.IPv6zero}},
+	}
+
+	for _, c := range cases {
+		defaultLBIP = c.defaultLBIP
+		services, err := client.getServices()
+		if err != nil {
+			t.Fatal(err)
+		}
+		servicesMap := make(map[string]ServiceInformation)
+		for _, service := range services {
+			servicesMap[service.Name] = service
+		}
+
+		web := servicesMap["web"]
+		assert.Equal(t, c.webIPs[0], web.Port.IP, c.defaultLBIP)
+		assert.Equal(t, c.webIPs, web.Port.IPs, c.defaultLBIP)
+		if assert.Len(t, web.Endpoints, 1) {
+			assert.Equal(t, "[fd00:10::1]:8080", web.Endpoints[0].HostPort())
+		}
+
+		lb := servicesMap["lb"]
+		assert.Equal(t, []net.IP{net.ParseIP("fd00::80")}, lb.Port.IPs, c.defaultLBIP)
+		assert.Equal(t, "fd000000000000000000000000000080_80__http", lb.Port.String())
+	}
+
+	_, err := parseDefaultLBIPs("0.0.0.0,foo")
+	assert.Error(t, err)
+}
@@ -23,6 +23,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
 )
 
 type Store interface {
@@ -131,3 +132,62 @@ func (s *EndpointsStore) List() ([]*v1.Endpoints, error) {
 	}
 	return endpoints, nil
 }
+
+type IngressStore struct {
+	*LocalStore
+}
+
+func (s *IngressStore) List() ([]*v1beta1.Ingress, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var ingresses []*v1beta1.Ingress
+	for _, o := range s.Objects {
+		ingress, ok := o.(*v1beta1.Ingress)
+		if !ok {
+			return nil, fmt.Errorf("couldn't convert ingress")
+		}
+		ingresses = append(ingresses, ingress)
+	}
+	return ingresses, nil
+}
+
+type SecretStore struct {
+	*LocalStore
+}
+
+func (s *SecretStore) Get(namespace, name string) (*v1.Secret, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, o := range s.Objects {
+		secret, ok := o.(*v1.Secret)
+		if !ok {
+			return nil, fmt.Errorf("couldn't convert secret")
+		}
+		if secret.Namespace == namespace && secret.Name == name {
+			return secret, nil
+		}
+	}
+	return nil, nil
+}
+
+type ConfigMapStore struct {
+	*LocalStore
+}
+
+func (s *ConfigMapStore) Get(namespace, name string) (*v1.ConfigMap, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, o := range s.Objects {
+		cm, ok := o.(*v1.ConfigMap)
+		if !ok {
+			return nil, fmt.Errorf("couldn't convert config map")
+		}
+		if cm.Namespace == namespace && cm.Name == name {
+			return cm, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+)
+
+var metricsAddress string
+
+func init() {
+	flag.StringVar(&metricsAddress, "metrics-address", "", "Address where metrics are served in /debug/vars, disabled if empty")
+}
+
+var conflictsMetric = expvar.NewMap("conflicts")
+var eventsDroppedMetric = expvar.NewInt("events_dropped")
+
+// setConflictsMetric sets the number of conflicts of each kind found in the
+// last update
+func setConflictsMetric(conflicts []Conflict) {
+	counts := map[string]int64{
+		ConflictServerName: 0,
+		ConflictPath:       0,
+		ConflictPort:       0,
+	}
+	for _, conflict := range conflicts {
+		counts[conflict.Kind]++
+	}
+	for kind, count := range counts {
+		value := new(expvar.Int)
+		value.Set(count)
+		conflictsMetric.Set(kind, value)
+	}
+}
+
+func serveMetrics(address string) {
+	log.Printf("Serving metrics in %s", address)
+	if err := http.ListenAndServe(address, nil); err != nil {
+		log.Printf("Couldn't serve metrics: %s", err)
+	}
+}
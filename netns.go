@@ -0,0 +1,93 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var procRoot = "/proc"
+var netnsPath string
+
+func init() {
+	flag.StringVar(&procRoot, "proc-root", procRoot, "Path where the proc filesystem used to read sysctls is mounted")
+	flag.StringVar(&netnsPath, "netns", "", "Path to the network namespace of the load balancer, as /proc/PID/ns/net, kube2lb namespace is used if empty")
+}
+
+// inNetNS runs a function in the network namespace of the load balancer.
+// The function is run in a locked thread that is moved to the namespace. The
+// thread is never unlocked, so it is terminated when the goroutine exits
+// instead of being reused, this requires Go 1.10 or later.
+func inNetNS(f func() error) error {
+	if netnsPath == "" {
+		return f()
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		target, err := os.Open(netnsPath)
+		if err != nil {
+			result <- err
+			return
+		}
+		defer target.Close()
+
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			result <- fmt.Errorf("couldn't enter network namespace %s: %s", netnsPath, err)
+			return
+		}
+
+		result <- f()
+	}()
+	return <-result
+}
+
+// readSysctl reads the value of a sysctl from the network namespace of the
+// load balancer
+func readSysctl(key string) (value string, err error) {
+	filename := path.Join(procRoot, "sys", strings.Replace(key, ".", "/", -1))
+	err = inNetNS(func() error {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		value = strings.TrimSpace(string(data))
+		return nil
+	})
+	return
+}
+
+// interfaceAddrs returns the addresses of the interfaces in the network
+// namespace of the load balancer
+func interfaceAddrs() (addrs []net.Addr, err error) {
+	err = inNetNS(func() error {
+		addrs, err = net.InterfaceAddrs()
+		return err
+	})
+	return
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestReadSysctlProcRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sysctlDir := path.Join(dir, "sys", "net", "ipv4")
+	if err := os.MkdirAll(sysctlDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(sysctlDir, "ip_local_port_range"), []byte("40000\t50000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldProcRoot := procRoot
+	defer func() { procRoot = oldProcRoot }()
+	procRoot = dir
+
+	value, err := readSysctl(ephemeralPortsRangeSysKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "40000\t50000", value)
+
+	r := initEphemeralPortsRangeCheck()
+	assert.Equal(t, &EphemeralPortsRange{check: true, LowPort: 40000, HighPort: 50000}, r)
+
+	_, err = readSysctl(nonLocalBindSysKey)
+	assert.Error(t, err)
+}
+
+func TestInNetNS(t *testing.T) {
+	oldNetnsPath := netnsPath
+	defer func() { netnsPath = oldNetnsPath }()
+
+	netnsPath = "/nonexistent/ns/net"
+	called := false
+	err := inNetNS(func() error {
+		called = true
+		return nil
+	})
+	assert.Error(t, err)
+	assert.False(t, called)
+
+	// Entering the current namespace requires privileges, but the namespace
+	// is not changed
+	netnsPath = "/proc/self/ns/net"
+	err = inNetNS(func() error {
+		called = true
+		return nil
+	})
+	if err != nil {
+		t.Skipf("Couldn't enter network namespace: %s", err)
+	}
+	assert.True(t, called)
+
+	_, err = interfaceAddrs()
+	assert.NoError(t, err)
+}
+
+type nopCheck struct{}
+
+func (nopCheck) ValidateService(*v1.Service) error {
+	return nil
+}
+
+func TestRefreshingCheck(t *testing.T) {
+	initializations := 0
+	check := NewRefreshingCheck(func() ServiceValidator {
+		initializations++
+		return nopCheck{}
+	})
+	assert.Equal(t, 1, initializations)
+
+	check.ValidateService(&v1.Service{})
+	assert.Equal(t, 1, initializations)
+
+	check.interval = 0
+	check.ValidateService(&v1.Service{})
+	assert.Equal(t, 2, initializations)
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var nginxNameReplacer = regexp.MustCompile("[^A-Za-z0-9_]")
+
+// nginxName formats a value so it can be used as name of an upstream or as
+// a variable, characters other than letters, numbers and underscores are
+// replaced
+func nginxName(v interface{}) string {
+	return nginxNameReplacer.ReplaceAllString(fmt.Sprint(v), "_")
+}
+
+// nginxQuote quotes a string as a single nginx configuration token
+func nginxQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// nginxToken quotes a string only if needed to be used as a single nginx
+// configuration token
+func nginxToken(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n;{}\"'\\#$") {
+		return nginxQuote(s)
+	}
+	return s
+}
+
+// nginxServerName formats a server name for the server_name directive,
+// regular expressions are quoted and keep the ~ prefix
+func nginxServerName(name serverName) string {
+	if name.IsRegexp() {
+		return nginxQuote("~" + name.Regexp())
+	}
+	return string(name)
+}
+
+// nginxListen returns the parameters of the listen directive for an IP of a
+// port, UDP ports can only be used in stream blocks. Socket options as
+// ipv6only are not included, nginx rejects them if they are repeated in the
+// virtual hosts of an address, and ipv6only is enabled by default.
+func nginxListen(port PortSpec, ip net.IP, ssl bool) string {
+	params := []string{joinHostPort(ip, port.Port)}
+	if port.Protocol == "udp" {
+		params = append(params, "udp")
+	}
+	if ssl {
+		params = append(params, "ssl")
+	}
+	return strings.Join(params, " ")
+}
+
+// nginxBalance returns the balancing directive for the upstream of a
+// service, empty for round robin, the nginx default
+func nginxBalance(s ServiceInformation) string {
+	switch {
+	case s.SessionAffinity != nil && s.SessionAffinity.ClientIP, s.Balance == "source":
+		return "hash $remote_addr consistent"
+	case s.Balance == "uri" && s.Port.Mode == "http":
+		return "hash $request_uri consistent"
+	case s.Balance == "random":
+		return "random"
+	case s.Balance == "roundrobin":
+		return ""
+	default:
+		return "least_conn"
+	}
+}
+
+// NginxLocation is a location of a virtual host, routed to an upstream
+type NginxLocation struct {
+	// Match contains the parameters of the location directive
+	Match string
+
+	// Upstream is the name of the upstream serving the location, empty if the
+	// service has no endpoints
+	Upstream string
+
+	// Rewrite is the quoted regular expression used to remove the
+	// prefix of requests, with the rest of the path in $1, empty if
+	// the prefix is not removed
+	Rewrite string
+
+	// Timeout in milliseconds for the upstream, zero if not declared
+	Timeout int
+}
+
+// IsRoot returns true if the location handles any path
+func (l NginxLocation) IsRoot() bool {
+	return l.Match == "/"
+}
+
+// NginxVirtualHost is a server block for a server name in a port
+type NginxVirtualHost struct {
+	// ServerName is the formatted server name
+	ServerName string
+
+	// CertFile contains the certificate and its key, empty if TLS is not
+	// used in the port
+	CertFile string
+
+	Locations []NginxLocation
+}
+
+// HasRoot returns true if some location handles any path
+func (h *NginxVirtualHost) HasRoot() bool {
+	for _, l := range h.Locations {
+		if l.IsRoot() {
+			return true
+		}
+	}
+	return false
+}
+
+func nginxLocation(s ServiceInformation, path PathRule) NginxLocation {
+	location := NginxLocation{
+		Timeout: s.Timeout,
+	}
+	if len(s.Endpoints) > 0 {
+		location.Upstream = nginxName(s)
+	}
+	switch {
+	case path.Path == "":
+		location.Match = "/"
+	case path.IsRegexp():
+		location.Match = "~ " + nginxQuote(path.Regexp())
+	default:
+		location.Match = nginxToken(path.Path)
+		if path.StripPrefix {
+			prefix := strings.TrimSuffix(path.Path, "/")
+			location.Rewrite = nginxQuote("^" + regexp.QuoteMeta(prefix) + "/?(.*)$")
+		}
+	}
+	return location
+}
+
+// nginxVirtualHosts groups the locations of the services in an HTTP port by
+// server name, nginx only uses the first server block for each name
+func nginxVirtualHosts(services []ServiceInformation, port PortSpec, domain string) []*NginxVirtualHost {
+	var defaultCertFile string
+	if certFiles := portCertificates(services, port); len(certFiles) > 0 {
+		defaultCertFile = certFiles[0]
+	}
+
+	var hosts []*NginxVirtualHost
+	hostsMap := make(map[string]*NginxVirtualHost)
+	for _, service := range services {
+		if service.Port.String() != port.String() {
+			continue
+		}
+		paths := service.Paths
+		if len(paths) == 0 {
+			paths = []PathRule{{}}
+		}
+		for _, name := range generateServerNames(service, domain) {
+			host, found := hostsMap[string(name)]
+			if !found {
+				host = &NginxVirtualHost{
+					ServerName: nginxServerName(name),
+					CertFile:   defaultCertFile,
+				}
+				hostsMap[string(name)] = host
+				hosts = append(hosts, host)
+			}
+			if service.TLS != nil && service.TLS.CertFile != "" {
+				host.CertFile = service.TLS.CertFile
+			}
+			for _, path := range paths {
+				host.Locations = append(host.Locations, nginxLocation(service, path))
+			}
+		}
+	}
+	return hosts
+}
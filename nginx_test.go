@@ -0,0 +1,172 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testNginxClusterInformation() *ClusterInformation {
+	http := PortSpec{IP: net.IPv4zero, IPs: []net.IP{net.IPv4zero, net.IPv6zero}, Port: 80, Mode: "http", Protocol: "tcp"}
+	https := PortSpec{IP: net.IPv4zero, IPs: []net.IP{net.IPv4zero}, Port: 443, Mode: "http", Protocol: "tcp"}
+	dnsPort := PortSpec{IP: net.ParseIP("10.0.0.10"), IPs: []net.IP{net.ParseIP("10.0.0.10")}, Port: 53, Protocol: "udp"}
+	dbPort := PortSpec{IP: net.IPv4zero, IPs: []net.IP{net.IPv4zero}, Port: 5432, Protocol: "tcp"}
+
+	web := ServiceInformation{
+		Name:      "web",
+		Namespace: "test",
+		Port:      http,
+		Endpoints: []ServiceEndpoint{
+			{Name: "web-1", IP: "10.1.0.1", Port: 8080},
+			{Name: "web-2", IP: "fd01::2", Port: 8080},
+		},
+		External: []string{"www.example.com", "~^web[0-9]+\\.example\\.com$"},
+	}
+	api := ServiceInformation{
+		Name:      "api",
+		Namespace: "test",
+		Port:      http,
+		Endpoints: []ServiceEndpoint{{Name: "api-1", IP: "10.1.0.3", Port: 8080}},
+		External:  []string{"www.example.com"},
+		Paths:     []PathRule{{Path: "/api", StripPrefix: true}, {Path: "~^/v[0-9]+/"}},
+		Timeout:   30000,
+		Balance:   "roundrobin",
+	}
+	secure := ServiceInformation{
+		Name:            "secure",
+		Namespace:       "test",
+		Port:            https,
+		Endpoints:       []ServiceEndpoint{{Name: "secure-1", IP: "10.1.0.4", Port: 8443}},
+		TLS:             &TLSInformation{CertFile: "/etc/kube2lb/certs/test_secure.pem"},
+		MaxConnections:  100,
+		SessionAffinity: &SessionAffinityInformation{ClientIP: true, Timeout: defaultSessionAffinityTimeout},
+	}
+	dns := ServiceInformation{
+		Name:      "dns",
+		Namespace: "kube-system",
+		Port:      dnsPort,
+		Endpoints: []ServiceEndpoint{{Name: "dns-1", IP: "10.1.0.5", Port: 53}},
+		Timeout:   5000,
+	}
+	docs := ServiceInformation{
+		Name:      "docs",
+		Namespace: "test",
+		Port:      http,
+		External:  []string{"docs.example.com"},
+	}
+	db := ServiceInformation{
+		Name:      "db",
+		Namespace: "test",
+		Port:      dbPort,
+		Endpoints: []ServiceEndpoint{
+			{Name: "db-1", IP: "10.1.0.6", Port: 5432, Weight: 3},
+			{Name: "db-2", IP: "10.1.0.7", Port: 5432, Weight: 0},
+		},
+		TrafficSplit: &TrafficSplitInformation{Group: "db"},
+	}
+	replica := ServiceInformation{
+		Name:      "replica",
+		Namespace: "test",
+		Port:      PortSpec{IP: net.IPv4zero, IPs: []net.IP{net.IPv4zero}, Port: 5433, Protocol: "tcp"},
+	}
+	return &ClusterInformation{
+		Services: []ServiceInformation{api, web, secure, dns, docs, db, replica},
+		Ports:    []PortSpec{http, https, dnsPort, dbPort, replica.Port},
+		Domain:   "cluster.local",
+
+		ACMEHTTPAddress: "127.0.0.1:5002",
+	}
+}
+
+func TestNginxTemplates(t *testing.T) {
+	if err := initServerNameTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		source string
+		golden string
+	}{
+		{"examples/nginx/nginx.conf.tpl", "testdata/nginx.conf"},
+		{"examples/nginx-stream/nginx.conf.tpl", "testdata/nginx-stream.conf"},
+	}
+	for _, c := range cases {
+		source, err := ioutil.ReadFile(c.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertGolden(t, string(source), testNginxClusterInformation(), c.golden)
+	}
+}
+
+func TestNginxHelpers(t *testing.T) {
+	if err := initServerNameTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "web_test_80_tcp_http", nginxName("web_test_80_tcp_http"))
+	assert.Equal(t, "a_b_c_", nginxName("a.b-c:"))
+
+	assert.Equal(t, `"a b"`, nginxQuote("a b"))
+	assert.Equal(t, `"\\d\"x"`, nginxQuote(`\d"x`))
+
+	assert.Equal(t, "www.example.com", nginxServerName(serverName("www.example.com")))
+	assert.Equal(t, `"~^www\\.example\\.com$"`, nginxServerName(serverName(`~^www\.example\.com$`)))
+
+	udp := PortSpec{Port: 53, Protocol: "udp"}
+	tcp := PortSpec{Port: 443, Protocol: "tcp", Mode: "http"}
+	assert.Equal(t, "0.0.0.0:53 udp", nginxListen(udp, net.IPv4zero, false))
+	assert.Equal(t, "[::]:443 ssl", nginxListen(tcp, net.IPv6zero, true))
+
+	assert.Equal(t, "least_conn", nginxBalance(ServiceInformation{}))
+	assert.Equal(t, "", nginxBalance(ServiceInformation{Balance: "roundrobin"}))
+	assert.Equal(t, "hash $remote_addr consistent", nginxBalance(ServiceInformation{Balance: "source"}))
+	assert.Equal(t, "hash $request_uri consistent", nginxBalance(ServiceInformation{Balance: "uri", Port: tcp}))
+	assert.Equal(t, "least_conn", nginxBalance(ServiceInformation{Balance: "uri", Port: udp}))
+
+	info := testNginxClusterInformation()
+	hosts := nginxVirtualHosts(info.Services, info.Ports[0], info.Domain)
+	names := make(map[string]*NginxVirtualHost)
+	for _, host := range hosts {
+		names[host.ServerName] = host
+	}
+	assert.Len(t, hosts, 6)
+
+	if www := names["www.example.com"]; assert.NotNil(t, www) {
+		assert.True(t, www.HasRoot())
+		assert.Equal(t, []NginxLocation{
+			{Match: "/api", Upstream: "api_test_80_tcp_http", Rewrite: `"^/api/?(.*)$"`, Timeout: 30000},
+			{Match: `~ "^/v[0-9]+/"`, Upstream: "api_test_80_tcp_http", Timeout: 30000},
+			{Match: "/", Upstream: "web_test_80_tcp_http"},
+		}, www.Locations)
+	}
+	if api := names["api.test.svc.cluster.local"]; assert.NotNil(t, api) {
+		assert.False(t, api.HasRoot())
+	}
+	if docs := names["docs.example.com"]; assert.NotNil(t, docs) {
+		assert.Equal(t, []NginxLocation{{Match: "/"}}, docs.Locations, "services without endpoints shouldn't have upstream")
+	}
+
+	secure := nginxVirtualHosts(info.Services, info.Ports[1], info.Domain)
+	if assert.Len(t, secure, 1) {
+		assert.Equal(t, "/etc/kube2lb/certs/test_secure.pem", secure[0].CertFile)
+	}
+}
@@ -47,6 +47,10 @@ func NewNotifier(definition string) (Notifier, error) {
 		return NewPidNotifier(d)
 	case "pidfile":
 		return NewPidfileNotifier(d)
+	case "keepalived":
+		return NewKeepalivedNotifier(d)
+	case "nginx":
+		return NewNginxNotifier(d)
 	case "debug":
 		return &DebugNotifier{}, nil
 	default:
@@ -129,6 +133,96 @@ func (n *PidfileNotifier) Notify(ctx context.Context) error {
 	return syscall.Kill(pid, n.signal)
 }
 
+const defaultKeepalivedPidfile = "/var/run/keepalived.pid"
+
+// Command used to check keepalived configurations, it can be replaced in tests
+var keepalivedCommand = "keepalived"
+
+type KeepalivedNotifier struct {
+	pidfile *PidfileNotifier
+	config  string
+}
+
+func NewKeepalivedNotifier(definition string) (*KeepalivedNotifier, error) {
+	// -notify keepalived:[PIDFILE[:CONFIG]]
+	ds := strings.SplitN(definition, ":", 2)
+	pidfile := ds[0]
+	if pidfile == "" {
+		pidfile = defaultKeepalivedPidfile
+	}
+	var config string
+	if len(ds) > 1 {
+		config = ds[1]
+	}
+	return &KeepalivedNotifier{
+		pidfile: &PidfileNotifier{pidfile: pidfile, signal: syscall.SIGHUP},
+		config:  config,
+	}, nil
+}
+
+// Notify checks the configuration, if known, and asks keepalived to reload
+// it, invalid configurations are not reloaded
+func (n *KeepalivedNotifier) Notify(ctx context.Context) error {
+	if n.config != "" {
+		err := checkConfiguration(ctx, keepalivedCommand, "--config-test", "--use-file", n.config)
+		if err != nil {
+			return err
+		}
+	}
+	return n.pidfile.Notify(ctx)
+}
+
+const defaultNginxPidfile = "/run/nginx.pid"
+
+// Command used to check nginx configurations, it can be replaced in tests
+var nginxCommand = "nginx"
+
+type NginxNotifier struct {
+	pidfile *PidfileNotifier
+	config  string
+}
+
+func NewNginxNotifier(definition string) (*NginxNotifier, error) {
+	// -notify nginx:[PIDFILE[:CONFIG]]
+	ds := strings.SplitN(definition, ":", 2)
+	pidfile := ds[0]
+	if pidfile == "" {
+		pidfile = defaultNginxPidfile
+	}
+	var config string
+	if len(ds) > 1 {
+		config = ds[1]
+	}
+	return &NginxNotifier{
+		pidfile: &PidfileNotifier{pidfile: pidfile, signal: syscall.SIGHUP},
+		config:  config,
+	}, nil
+}
+
+// Notify checks the configuration and asks the nginx master process to
+// reload it, invalid configurations are not reloaded
+func (n *NginxNotifier) Notify(ctx context.Context) error {
+	args := []string{"-t"}
+	if n.config != "" {
+		args = append(args, "-c", n.config)
+	}
+	if err := checkConfiguration(ctx, nginxCommand, args...); err != nil {
+		return err
+	}
+	return n.pidfile.Notify(ctx)
+}
+
+// checkConfiguration runs a command that checks a configuration, the output
+// of the command is included in the error if the check fails
+func checkConfiguration(ctx context.Context, command string, args ...string) error {
+	cmd := exec.CommandContext(ctx, command, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("invalid configuration, %s failed: %s: %s", command, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
 type DebugNotifier struct{}
 
 func (n *DebugNotifier) Notify(ctx context.Context) error {
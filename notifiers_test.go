@@ -16,7 +16,17 @@ limitations under the License.
 
 package main
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
 
 var definitionCases = []struct {
 	Definition string
@@ -31,6 +41,10 @@ var definitionCases = []struct {
 	{"pid:SIGTERM:100", false},
 	{"pidfile:SIGTERM:test.pid", false},
 	{"command:echo", false},
+	{"keepalived:", false},
+	{"keepalived:/run/keepalived.pid:/etc/keepalived/keepalived.conf", false},
+	{"nginx:", false},
+	{"nginx:/run/nginx.pid:/etc/nginx/nginx.conf", false},
 }
 
 func TestNotifierDefinitions(t *testing.T) {
@@ -44,3 +58,63 @@ func TestNotifierDefinitions(t *testing.T) {
 		}
 	}
 }
+
+// testNotifierChecks checks that a notifier only signals the process in the
+// pidfile if its configuration check passes
+func testNotifierChecks(t *testing.T, command *string, newNotifier func(pidfile string) (Notifier, error)) {
+	oldCommand := *command
+	defer func() { *command = oldCommand }()
+
+	dir, err := ioutil.TempDir("", "kube2lb-notifiers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pidfile := filepath.Join(dir, "test.pid")
+	err = ioutil.WriteFile(pidfile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	n, err := newNotifier(pidfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	*command = "false"
+	if err := n.Notify(context.Background()); err == nil {
+		t.Fatal("process shouldn't be notified if configuration is not valid")
+	}
+	select {
+	case <-signals:
+		t.Fatal("unexpected signal with invalid configuration")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	*command = "true"
+	if err := n.Notify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-signals:
+	case <-time.After(time.Second):
+		t.Fatal("process not notified")
+	}
+}
+
+func TestKeepalivedNotifier(t *testing.T) {
+	testNotifierChecks(t, &keepalivedCommand, func(pidfile string) (Notifier, error) {
+		return NewKeepalivedNotifier(pidfile + ":/etc/keepalived/keepalived.conf")
+	})
+}
+
+func TestNginxNotifier(t *testing.T) {
+	testNotifierChecks(t, &nginxCommand, func(pidfile string) (Notifier, error) {
+		return NewNginxNotifier(pidfile)
+	})
+}
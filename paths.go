@@ -0,0 +1,103 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// PathRule is a path prefix, or a regexp if it starts with `~`, used to route
+// requests to a service that shares server names with other services
+type PathRule struct {
+	Path        string `json:"path"`
+	StripPrefix bool   `json:"strip-prefix"`
+}
+
+// UnmarshalJSON allows to declare path rules as plain strings or as objects
+func (r *PathRule) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*r = PathRule{Path: path}
+		return nil
+	}
+	type pathRule PathRule
+	var rule pathRule
+	if err := json.Unmarshal(data, &rule); err != nil {
+		return err
+	}
+	*r = PathRule(rule)
+	return nil
+}
+
+func (r PathRule) String() string {
+	return r.Path
+}
+
+func (r PathRule) IsRegexp() bool {
+	return strings.HasPrefix(r.Path, "~")
+}
+
+func (r PathRule) Regexp() string {
+	return strings.TrimPrefix(r.Path, "~")
+}
+
+// PathRoute is a rule to route requests for the server names of a service,
+// Path is nil for services without paths, that receive any request
+type PathRoute struct {
+	Service ServiceInformation
+	Path    *PathRule
+}
+
+// specificity returns the order in which a path rule has to be evaluated,
+// lower values go first. Prefixes are evaluated before regexps, and the
+// root prefix is evaluated last, as it matches any path.
+func (r *PathRule) specificity() int {
+	switch {
+	case r == nil || r.Path == "/":
+		return 2
+	case r.IsRegexp():
+		return 1
+	default:
+		return 0
+	}
+}
+
+// pathRoutes returns the routes of a list of services sorted so more
+// specific rules are evaluated first, longest prefixes go first, then
+// regexps, and then the rules that match any path
+func pathRoutes(services []ServiceInformation) []PathRoute {
+	var routes []PathRoute
+	for _, s := range services {
+		if len(s.Paths) == 0 {
+			routes = append(routes, PathRoute{Service: s})
+			continue
+		}
+		for i := range s.Paths {
+			routes = append(routes, PathRoute{Service: s, Path: &s.Paths[i]})
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i].Path, routes[j].Path
+		if a.specificity() != b.specificity() {
+			return a.specificity() < b.specificity()
+		}
+		return a.specificity() == 0 && len(a.Path) > len(b.Path)
+	})
+	return routes
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathRulesAnnotation(t *testing.T) {
+	annotation := `{"http": ["/api", "~^/v[0-9]+/", {"path": "/static", "strip-prefix": true}]}`
+
+	var paths map[string][]PathRule
+	if err := json.Unmarshal([]byte(annotation), &paths); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []PathRule{
+		{Path: "/api"},
+		{Path: "~^/v[0-9]+/"},
+		{Path: "/static", StripPrefix: true},
+	}
+	assert.Equal(t, expected, paths["http"])
+	assert.False(t, paths["http"][0].IsRegexp())
+	assert.True(t, paths["http"][1].IsRegexp())
+	assert.Equal(t, "^/v[0-9]+/", paths["http"][1].Regexp())
+}
+
+func TestResolvePathConflicts(t *testing.T) {
+	if err := initServerNameTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	port := PortSpec{IP: net.IPv4zero, Port: 80, Mode: "http", Protocol: "tcp"}
+	external := []string{"api.example.com"}
+	services := []ServiceInformation{
+		{Name: "b", Namespace: "test", Port: port, External: external, Paths: []PathRule{{Path: "/users"}, {Path: "/orders"}}},
+		{Name: "a", Namespace: "test", Port: port, External: external, Paths: []PathRule{{Path: "/users"}}},
+		{Name: "c", Namespace: "test", Port: port, External: external, Paths: []PathRule{{Path: "/orders"}}},
+		{Name: "d", Namespace: "test", Port: port, External: external},
+	}
+
+	resolved, conflicts := resolveConflicts(services, "local")
+	resolvedMap := make(map[string]ServiceInformation)
+	for _, service := range resolved {
+		resolvedMap[service.Name] = service
+	}
+
+	assert.Equal(t, 3, len(resolved), "service with all paths in conflict should be removed")
+	assert.Equal(t, []PathRule{{Path: "/users"}}, resolvedMap["a"].Paths)
+	assert.Equal(t, []PathRule{{Path: "/orders"}}, resolvedMap["b"].Paths)
+	assert.Contains(t, resolvedMap, "d")
+	assert.NotContains(t, resolvedMap, "c")
+	assert.Len(t, conflicts, 2)
+
+}
+
+func TestPathRoutes(t *testing.T) {
+	services := []ServiceInformation{
+		{Name: "root", Paths: []PathRule{{Path: "/"}}},
+		{Name: "any"},
+		{Name: "web", Paths: []PathRule{{Path: "/api"}, {Path: "~^/v[0-9]+/"}}},
+		{Name: "admin", Paths: []PathRule{{Path: "/api/admin"}, {Path: "/a"}}},
+	}
+
+	var routes []string
+	for _, r := range pathRoutes(services) {
+		route := r.Service.Name
+		if r.Path != nil {
+			route += " " + r.Path.Path
+		}
+		routes = append(routes, route)
+	}
+	expected := []string{
+		"admin /api/admin",
+		"web /api",
+		"admin /a",
+		"web ~^/v[0-9]+/",
+		"root /",
+		"any",
+	}
+	assert.Equal(t, expected, routes)
+}
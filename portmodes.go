@@ -0,0 +1,64 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	PortModeHTTP = "http"
+	PortModeTCP  = "tcp"
+)
+
+// SCTP is not defined in the version of the API used by kube2lb
+const protocolSCTP = v1.Protocol("SCTP")
+
+// validateDefaultPortMode checks that a mode can be used as default mode for
+// TCP ports
+func validateDefaultPortMode(mode string) error {
+	switch strings.ToLower(mode) {
+	case PortModeHTTP, PortModeTCP:
+		return nil
+	}
+	return fmt.Errorf("unknown port mode %q, valid modes are %s and %s", mode, PortModeHTTP, PortModeTCP)
+}
+
+// portMode returns the mode for a port, given its protocol and its mode as
+// declared in annotations, if any. Modes are only meaningful for TCP ports,
+// ports with other protocols have an empty mode.
+func portMode(protocol v1.Protocol, annotated string) (string, error) {
+	mode := strings.ToLower(annotated)
+	switch protocol {
+	case v1.ProtocolTCP, "":
+		if mode == "" {
+			return strings.ToLower(defaultPortMode), nil
+		}
+		if err := validateDefaultPortMode(mode); err != nil {
+			return strings.ToLower(defaultPortMode), err
+		}
+		return mode, nil
+	default:
+		if mode != "" {
+			return "", fmt.Errorf("modes can only be used with TCP ports, %s ports don't have modes", protocol)
+		}
+		return "", nil
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestPortMode(t *testing.T) {
+	cases := []struct {
+		protocol  v1.Protocol
+		annotated string
+		mode      string
+		valid     bool
+	}{
+		{v1.ProtocolTCP, "", "http", true},
+		{"", "", "http", true},
+		{v1.ProtocolTCP, "tcp", "tcp", true},
+		{v1.ProtocolTCP, "HTTP", "http", true},
+		{v1.ProtocolTCP, "udp", "http", false},
+		{v1.ProtocolUDP, "", "", true},
+		{v1.ProtocolUDP, "http", "", false},
+		{v1.ProtocolUDP, "tcp", "", false},
+		{protocolSCTP, "", "", true},
+		{protocolSCTP, "http", "", false},
+	}
+
+	for _, c := range cases {
+		mode, err := portMode(c.protocol, c.annotated)
+		assert.Equal(t, c.mode, mode, "%s %q", c.protocol, c.annotated)
+		if c.valid {
+			assert.NoError(t, err, "%s %q", c.protocol, c.annotated)
+		} else {
+			assert.Error(t, err, "%s %q", c.protocol, c.annotated)
+		}
+	}
+
+	assert.NoError(t, validateDefaultPortMode("TCP"))
+	assert.Error(t, validateDefaultPortMode("udp"))
+}
+
+func TestKubernetesUDPPorts(t *testing.T) {
+	client := &KubernetesClient{
+		serviceStore:   ServiceStore{NewLocalStore()},
+		endpointsStore: EndpointsStore{NewLocalStore()},
+	}
+
+	client.serviceStore.Update(&v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			SelfLink:  "/service/dns",
+			Name:      "dns",
+			Namespace: "test",
+			Annotations: map[string]string{
+				PortModeAnnotation: `{"dns": "http", "dns-tcp": "tcp"}`,
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{
+				{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+				{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP},
+				{Name: "metrics", Port: 9153, Protocol: v1.ProtocolTCP},
+			},
+		},
+	})
+	client.endpointsStore.Update(&v1.Endpoints{
+		ObjectMeta: meta_v1.ObjectMeta{SelfLink: "/endpoints/dns", Name: "dns", Namespace: "test"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+				Ports: []v1.EndpointPort{
+					{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+					{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP},
+					{Name: "metrics", Port: 9153, Protocol: v1.ProtocolTCP},
+				},
+			},
+		},
+	})
+
+	services, err := client.getServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := make(map[string]string)
+	for _, service := range services {
+		modes[service.PortName] = service.Port.Mode
+	}
+	assert.Equal(t, map[string]string{"dns": "", "dns-tcp": "tcp", "metrics": "http"}, modes)
+}
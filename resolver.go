@@ -0,0 +1,189 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+var resolverRefresh = 30 * time.Second
+
+func init() {
+	flag.DurationVar(&resolverRefresh, "resolver-refresh", resolverRefresh, "Interval to resolve again names resolved by kube2lb, as ExternalName services with static resolution or node names in keepalived templates")
+}
+
+// Names not used for this number of refresh intervals are forgotten
+const resolverExpirationIntervals = 10
+
+// errNotResolvedYet is returned for names that are being resolved for the
+// first time
+var errNotResolvedYet = errors.New("not resolved yet")
+
+type resolverEntry struct {
+	addresses []string
+	err       error
+
+	resolvedAt time.Time
+	usedAt     time.Time
+	resolving  bool
+}
+
+// Resolver resolves names in background and caches the results, so updates
+// are not blocked by slow DNS servers. Cached results are returned while
+// names are resolved again, and notify is called when they change so the
+// configuration can be generated again.
+type Resolver struct {
+	sync.Mutex
+
+	lookup  func(string) ([]string, error)
+	entries map[string]*resolverEntry
+	notify  func()
+
+	// Interval to resolve names again, resolverRefresh if zero
+	refresh time.Duration
+}
+
+func NewResolver(lookup func(string) ([]string, error)) *Resolver {
+	return &Resolver{
+		lookup:  lookup,
+		entries: make(map[string]*resolverEntry),
+	}
+}
+
+func (r *Resolver) refreshInterval() time.Duration {
+	if r.refresh == 0 {
+		return resolverRefresh
+	}
+	return r.refresh
+}
+
+// hostResolver is the resolver used for names resolved by kube2lb
+var hostResolver = NewResolver(net.LookupHost)
+
+// SetNotify sets the function called when the addresses of a name change
+func (r *Resolver) SetNotify(notify func()) {
+	r.Lock()
+	defer r.Unlock()
+	r.notify = notify
+}
+
+// Lookup returns the cached addresses of a name, sorted. Names are resolved
+// in background if they are not cached or their addresses are too old,
+// errNotResolvedYet is returned if there are no results yet.
+func (r *Resolver) Lookup(name string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	r.forget(now)
+
+	entry, found := r.entries[name]
+	if !found {
+		entry = &resolverEntry{err: errNotResolvedYet}
+		r.entries[name] = entry
+	}
+	entry.usedAt = now
+	if !entry.resolving && now.Sub(entry.resolvedAt) >= r.refreshInterval() {
+		entry.resolving = true
+		go r.Resolve(name)
+	}
+	return entry.addresses, entry.err
+}
+
+// Resolve resolves a name and caches the result, notify is called out of
+// the lock as it can block till a running update finishes, and updates can
+// be looking up names
+func (r *Resolver) Resolve(name string) {
+	addresses, err := r.lookup(name)
+	sort.Strings(addresses)
+
+	r.Lock()
+
+	entry, found := r.entries[name]
+	if !found {
+		entry = &resolverEntry{usedAt: time.Now()}
+		r.entries[name] = entry
+	}
+	entry.resolvedAt = time.Now()
+	entry.resolving = false
+
+	if err != nil && len(entry.addresses) > 0 {
+		// Temporary failures don't remove known addresses
+		log.Printf("Couldn't resolve %s, using last known addresses: %s", name, err)
+		r.Unlock()
+		return
+	}
+	if err != nil {
+		log.Printf("Couldn't resolve %s: %s", name, err)
+	}
+	changed := !reflect.DeepEqual(addresses, entry.addresses) || (err == nil) != (entry.err == nil)
+	entry.addresses, entry.err = addresses, err
+	notify := r.notify
+	r.Unlock()
+
+	if changed && notify != nil {
+		notify()
+	}
+}
+
+// Run resolves again the cached names every refresh interval, till the
+// context is done
+func (r *Resolver) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.refreshInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.resolveStale()
+	}
+}
+
+// resolveStale starts the resolution of the cached names whose addresses are
+// too old, and forgets the ones not used for a while
+func (r *Resolver) resolveStale() {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	r.forget(now)
+	for name, entry := range r.entries {
+		if !entry.resolving && now.Sub(entry.resolvedAt) >= r.refreshInterval() {
+			entry.resolving = true
+			go r.Resolve(name)
+		}
+	}
+}
+
+// forget removes the names that haven't been used for a while
+func (r *Resolver) forget(now time.Time) {
+	for name, entry := range r.entries {
+		if !entry.resolving && now.Sub(entry.usedAt) > resolverExpirationIntervals*r.refreshInterval() {
+			delete(r.entries, name)
+		}
+	}
+}
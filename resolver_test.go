@@ -0,0 +1,139 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolver(t *testing.T) {
+	var lock sync.Mutex
+	addresses := []string{"10.0.0.2", "10.0.0.1"}
+	var lookupErr error
+	lookup := func(name string) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return addresses, lookupErr
+	}
+	setResult := func(a []string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		addresses, lookupErr = a, err
+	}
+
+	notified := make(chan struct{}, 10)
+	r := NewResolver(lookup)
+	r.SetNotify(func() { notified <- struct{}{} })
+
+	assertNotified := func(expected bool, message string) {
+		select {
+		case <-notified:
+			assert.True(t, expected, message)
+		case <-time.After(100 * time.Millisecond):
+			assert.False(t, expected, message)
+		}
+	}
+
+	_, err := r.Lookup("example.com")
+	assert.Equal(t, errNotResolvedYet, err, "names are resolved in background")
+	assertNotified(true, "first resolution")
+
+	found, err := r.Lookup("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, found)
+
+	// Same addresses, no notification
+	r.Resolve("example.com")
+	assertNotified(false, "addresses didn't change")
+
+	// Temporary errors keep known addresses
+	setResult(nil, fmt.Errorf("timeout"))
+	r.Resolve("example.com")
+	assertNotified(false, "errors keep known addresses")
+	found, err = r.Lookup("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, found)
+
+	setResult([]string{"10.0.0.3"}, nil)
+	r.Resolve("example.com")
+	assertNotified(true, "addresses changed")
+	found, _ = r.Lookup("example.com")
+	assert.Equal(t, []string{"10.0.0.3"}, found)
+
+	// Unknown names are reported after the first resolution
+	setResult(nil, fmt.Errorf("unknown host"))
+	r.Resolve("unknown.example.com")
+	_, err = r.Lookup("unknown.example.com")
+	assert.EqualError(t, err, "unknown host")
+}
+
+func TestResolverNotifyOutOfLock(t *testing.T) {
+	r := NewResolver(func(string) ([]string, error) { return []string{"10.0.0.1"}, nil })
+
+	// Notify functions can look up names, as updates do
+	done := make(chan struct{})
+	r.SetNotify(func() {
+		r.Lookup("example.com")
+		close(done)
+	})
+	go r.Resolve("example.com")
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resolver blocked while notifying")
+	}
+}
+
+func TestResolverRefresh(t *testing.T) {
+	var lock sync.Mutex
+	address := "10.0.0.1"
+	r := NewResolver(func(string) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return []string{address}, nil
+	})
+	r.refresh = 10 * time.Millisecond
+	notified := make(chan struct{}, 10)
+	r.SetNotify(func() { notified <- struct{}{} })
+
+	r.Resolve("example.com")
+	<-notified
+
+	lock.Lock()
+	address = "10.0.0.2"
+	lock.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("names should be resolved again without lookups")
+	}
+	found, err := r.Lookup("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, found)
+}
@@ -17,20 +17,32 @@ limitations under the License.
 package main
 
 import (
+	"bufio"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/achanda/go-sysctl"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/pkg/api/v1"
 )
 
 const (
 	addressesExpiration = 5 * time.Second
 
+	// This range is also used for IPv6
 	ephemeralPortsRangeSysKey = "net.ipv4.ip_local_port_range"
 	nonLocalBindSysKey        = "net.ipv4.ip_nonlocal_bind"
+	nonLocalBindIPv6SysKey    = "net.ipv6.ip_nonlocal_bind"
+
+	unprivilegedPortStartSysKey = "net.ipv4.ip_unprivileged_port_start"
 )
 
 type ServiceValidator interface {
@@ -39,8 +51,66 @@ type ServiceValidator interface {
 
 var (
 	sanityChecks []ServiceValidator
+
+	sanityChecksArg = "ephemeral-ports,lb-ip-address,lb-ip-cidrs,own-listeners"
+	lbIPCIDRsArg    string
+
+	sanityChecksRefresh = time.Minute
 )
 
+// Registry of available sanity checks by name, checks are initialized after
+// parsing flags
+var sanityCheckFactories = map[string]func() (ServiceValidator, error){
+	"ephemeral-ports": func() (ServiceValidator, error) {
+		return NewRefreshingCheck(func() ServiceValidator { return initEphemeralPortsRangeCheck() }), nil
+	},
+	"lb-ip-address": func() (ServiceValidator, error) {
+		return NewRefreshingCheck(func() ServiceValidator { return initAddressForLoadBalancerIPCheck() }), nil
+	},
+	"lb-ip-cidrs":   func() (ServiceValidator, error) { return initLoadBalancerIPCIDRsCheck(lbIPCIDRsArg) },
+	"own-listeners": func() (ServiceValidator, error) { return initOwnListenersCheck() },
+	"privileged-ports": func() (ServiceValidator, error) {
+		return NewRefreshingCheck(func() ServiceValidator { return initPrivilegedPortsCheck() }), nil
+	},
+	"external-domains": func() (ServiceValidator, error) { return ExternalDomainsValidator{}, nil },
+}
+
+func init() {
+	flag.StringVar(&sanityChecksArg, "sanity-checks", sanityChecksArg, "Comma-separated list of sanity checks for services, available checks: ephemeral-ports, lb-ip-address, lb-ip-cidrs, own-listeners, privileged-ports, external-domains")
+	flag.DurationVar(&sanityChecksRefresh, "sanity-checks-refresh", sanityChecksRefresh, "Interval to refresh the information about the environment used by sanity checks")
+	flag.StringVar(&lbIPCIDRsArg, "lb-ip-cidrs", "", "Comma-separated list of CIDRs where load balancer IPs of services must be, any IP is allowed if empty")
+}
+
+// initSanityChecks initializes the sanity checks enabled with flags
+func initSanityChecks() error {
+	checks, err := newSanityChecks(sanityChecksArg)
+	if err != nil {
+		return err
+	}
+	sanityChecks = checks
+	return nil
+}
+
+func newSanityChecks(names string) ([]ServiceValidator, error) {
+	var checks []ServiceValidator
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		factory, found := sanityCheckFactories[name]
+		if !found {
+			return nil, fmt.Errorf("unknown sanity check '%s'", name)
+		}
+		check, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't initialize sanity check '%s': %s", name, err)
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
 func ValidateService(s *v1.Service) error {
 	for _, check := range sanityChecks {
 		if err := check.ValidateService(s); err != nil {
@@ -50,6 +120,36 @@ func ValidateService(s *v1.Service) error {
 	return nil
 }
 
+// RefreshingCheck is a sanity check that is periodically initialized again,
+// for checks that depend on the environment of the load balancer
+type RefreshingCheck struct {
+	sync.Mutex
+
+	init        func() ServiceValidator
+	interval    time.Duration
+	check       ServiceValidator
+	initialized time.Time
+}
+
+func NewRefreshingCheck(init func() ServiceValidator) *RefreshingCheck {
+	return &RefreshingCheck{
+		init:        init,
+		interval:    sanityChecksRefresh,
+		check:       init(),
+		initialized: time.Now(),
+	}
+}
+
+func (r *RefreshingCheck) ValidateService(s *v1.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	if time.Since(r.initialized) >= r.interval {
+		r.check = r.init()
+		r.initialized = time.Now()
+	}
+	return r.check.ValidateService(s)
+}
+
 type EphemeralPortsRange struct {
 	check    bool
 	LowPort  int32
@@ -81,7 +181,7 @@ func (r EphemeralPortsRange) ValidateService(s *v1.Service) error {
 // Retrieve the data from sysctl and return the values, disable the check if unsuccessful and log
 func initEphemeralPortsRangeCheck() *EphemeralPortsRange {
 	var l, h int32
-	r, err := sysctl.Get(ephemeralPortsRangeSysKey)
+	r, err := readSysctl(ephemeralPortsRangeSysKey)
 	if err != nil {
 		log.Printf("Error reading %s from sysctl: %s, skipping ephemeral ports range checks", ephemeralPortsRangeSysKey, err)
 		return &EphemeralPortsRange{check: false, LowPort: 0, HighPort: 0}
@@ -91,19 +191,16 @@ func initEphemeralPortsRangeCheck() *EphemeralPortsRange {
 	return &EphemeralPortsRange{check: true, LowPort: l, HighPort: h}
 }
 
-func init() {
-	sanityChecks = append(sanityChecks, initEphemeralPortsRangeCheck())
-}
-
 type AddressForLoadBalancerIP struct {
 	checkLocalBind     bool
+	checkLocalBindIPv6 bool
 	interfaceAddresses []net.Addr
 	addressesTime      time.Time
 }
 
 func (a *AddressForLoadBalancerIP) addresses() ([]net.Addr, error) {
 	if a.addressesTime.IsZero() || time.Since(a.addressesTime) > addressesExpiration {
-		addresses, err := net.InterfaceAddrs()
+		addresses, err := interfaceAddrs()
 		if err != nil {
 			return nil, err
 		}
@@ -113,18 +210,24 @@ func (a *AddressForLoadBalancerIP) addresses() ([]net.Addr, error) {
 	return a.interfaceAddresses, nil
 }
 
-func (a AddressForLoadBalancerIP) ValidateService(s *v1.Service) error {
-	if s.Spec.Type != v1.ServiceTypeLoadBalancer || s.Spec.LoadBalancerIP == "" {
+func (a *AddressForLoadBalancerIP) ValidateService(s *v1.Service) error {
+	lbIP := loadBalancerIP(s)
+	if lbIP == "" {
 		return nil
 	}
 
-	ip := net.ParseIP(s.Spec.LoadBalancerIP)
+	ip := net.ParseIP(lbIP)
 	if ip == nil {
 		return fmt.Errorf("couldn't parse IP '%s' for service %s in %s",
-			s.Spec.LoadBalancerIP, s.Name, s.Namespace)
+			lbIP, s.Name, s.Namespace)
+	}
+
+	checkLocalBind := a.checkLocalBind
+	if ip.To4() == nil {
+		checkLocalBind = a.checkLocalBindIPv6
 	}
 
-	if a.checkLocalBind {
+	if checkLocalBind {
 		addrs, err := a.addresses()
 		if err != nil {
 			log.Printf("Error obtaining local interface addresses: %s", err)
@@ -138,22 +241,263 @@ func (a AddressForLoadBalancerIP) ValidateService(s *v1.Service) error {
 				}
 			}
 		}
-		return fmt.Errorf("service %s in %s cannot be bound to address %s defined in load balancer IP, skipping it. Please check your configuration!", s.Name, s.Namespace, s.Spec.LoadBalancerIP)
+		return fmt.Errorf("service %s in %s cannot be bound to address %s defined in load balancer IP, skipping it. Please check your configuration!", s.Name, s.Namespace, lbIP)
 	}
 
 	return nil
 }
 
 func initAddressForLoadBalancerIPCheck() *AddressForLoadBalancerIP {
-	nonLocalBind, err := sysctl.Get(nonLocalBindSysKey)
+	var check AddressForLoadBalancerIP
+
+	nonLocalBind, err := readSysctl(nonLocalBindSysKey)
 	if err != nil {
 		log.Printf("Error reading %s from sysctl: %s, skipping load balancer IP checks", nonLocalBindSysKey, err)
-		return &AddressForLoadBalancerIP{checkLocalBind: false}
+	} else {
+		check.checkLocalBind = nonLocalBind == "0"
 	}
 
-	return &AddressForLoadBalancerIP{checkLocalBind: nonLocalBind == "0"}
+	// Non-local binds for IPv6 are not supported by old kernels
+	nonLocalBind, err = readSysctl(nonLocalBindIPv6SysKey)
+	if err != nil {
+		log.Printf("Error reading %s from sysctl: %s, skipping load balancer IPv6 checks", nonLocalBindIPv6SysKey, err)
+	} else {
+		check.checkLocalBindIPv6 = nonLocalBind == "0"
+	}
+
+	return &check
 }
 
-func init() {
-	sanityChecks = append(sanityChecks, initAddressForLoadBalancerIPCheck())
+// PrivilegedPorts checks that services don't use ports that require
+// privileges to be bound in the network namespace of the load balancer
+type PrivilegedPorts struct {
+	check bool
+
+	// UnprivilegedPortStart is the first port that can be bound without
+	// privileges
+	UnprivilegedPortStart int32
+}
+
+func (p PrivilegedPorts) ValidateService(s *v1.Service) error {
+	if !p.check {
+		return nil
+	}
+	for _, port := range s.Spec.Ports {
+		if port.Port < p.UnprivilegedPortStart {
+			return fmt.Errorf("service %s in %s Service Port %d is privileged and it cannot be bound without root privileges, skipping it", s.Name, s.Namespace, port.Port)
+		}
+	}
+	return nil
+}
+
+const (
+	// Ports below this limit are privileged in kernels without the
+	// net.ipv4.ip_unprivileged_port_start sysctl
+	privilegedPortsLimit = 1024
+
+	capNetBindService = 10
+)
+
+// canBindPrivilegedPorts returns true if running as root or with the
+// CAP_NET_BIND_SERVICE capability
+func canBindPrivilegedPorts() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return hasEffectiveCapability(f, capNetBindService)
+}
+
+// hasEffectiveCapability looks for a capability in the effective set of a
+// process status, as found in /proc/PID/status
+func hasEffectiveCapability(status io.Reader, capability uint) bool {
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return false
+		}
+		return caps&(1<<capability) != 0
+	}
+	return false
+}
+
+// Retrieve the first unprivileged port from sysctl, the classic limit is used
+// if the sysctl is not available. Nothing is checked if kube2lb can bind
+// privileged ports
+func initPrivilegedPortsCheck() *PrivilegedPorts {
+	if canBindPrivilegedPorts() {
+		return &PrivilegedPorts{check: false}
+	}
+	r, err := readSysctl(unprivilegedPortStartSysKey)
+	if err != nil {
+		log.Printf("Error reading %s from sysctl: %s, using %d as first unprivileged port", unprivilegedPortStartSysKey, err, privilegedPortsLimit)
+		return &PrivilegedPorts{check: true, UnprivilegedPortStart: privilegedPortsLimit}
+	}
+	start, err := strconv.ParseInt(r, 10, 32)
+	if err != nil {
+		log.Printf("Couldn't parse %s: %s, skipping privileged ports checks", unprivilegedPortStartSysKey, err)
+		return &PrivilegedPorts{check: false}
+	}
+	return &PrivilegedPorts{check: true, UnprivilegedPortStart: int32(start)}
+}
+
+// OwnListeners checks that services don't use the addresses where kube2lb
+// itself listens
+type OwnListeners struct {
+	listeners []*net.TCPAddr
+}
+
+func (o OwnListeners) ValidateService(s *v1.Service) error {
+	for _, port := range s.Spec.Ports {
+		if port.Protocol != "" && port.Protocol != v1.ProtocolTCP {
+			continue
+		}
+		for _, listener := range o.listeners {
+			if int(port.Port) != listener.Port {
+				continue
+			}
+			for _, ip := range serviceLBIPs(s) {
+				if ip.IsUnspecified() || len(listener.IP) == 0 || listener.IP.IsUnspecified() || listener.IP.Equal(ip) {
+					return fmt.Errorf("service %s in %s Service Port %d collides with kube2lb listener in %s, skipping it", s.Name, s.Namespace, port.Port, listener)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func initOwnListenersCheck() (*OwnListeners, error) {
+	var addresses []string
+	if metricsAddress != "" {
+		addresses = append(addresses, metricsAddress)
+	}
+	if acmeDirectoryURL != "" {
+		addresses = append(addresses, acmeHTTPAddress)
+	}
+	if xdsServerAddress != "" {
+		addresses = append(addresses, xdsServerAddress)
+	}
+
+	var o OwnListeners
+	for _, address := range addresses {
+		listener, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		o.listeners = append(o.listeners, listener)
+	}
+	return &o, nil
+}
+
+// LoadBalancerIPCIDRs checks that load balancer IPs requested by services,
+// or allocated to them from pools, are in one of the allowed networks
+type LoadBalancerIPCIDRs struct {
+	cidrs []*net.IPNet
+}
+
+func (l LoadBalancerIPCIDRs) ValidateService(s *v1.Service) error {
+	lbIP := loadBalancerIP(s)
+	if len(l.cidrs) == 0 || lbIP == "" {
+		return nil
+	}
+	ip := net.ParseIP(lbIP)
+	if ip == nil {
+		return fmt.Errorf("couldn't parse IP '%s' for service %s in %s",
+			lbIP, s.Name, s.Namespace)
+	}
+	for _, cidr := range l.cidrs {
+		if cidr.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("load balancer IP %s of service %s in %s is not in any of the allowed networks, skipping it", ip, s.Name, s.Namespace)
+}
+
+func initLoadBalancerIPCIDRsCheck(cidrs string) (*LoadBalancerIPCIDRs, error) {
+	var l LoadBalancerIPCIDRs
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		l.cidrs = append(l.cidrs, network)
+	}
+	return &l, nil
+}
+
+// ExternalDomainsValidator checks the entries of the external domains
+// annotation, they can be hostnames, wildcards or regular expressions.
+// Invalid entries are ignored, unless it is enabled as sanity check, then
+// services with invalid entries are skipped.
+type ExternalDomainsValidator struct{}
+
+// ExternalDomains returns the valid external domains of a service, and
+// errors for the invalid ones
+func (ExternalDomainsValidator) ExternalDomains(s *v1.Service) ([]string, []error) {
+	domains, ok := s.ObjectMeta.Annotations[ExternalDomainsAnnotation]
+	if !ok || len(domains) == 0 {
+		return nil, nil
+	}
+
+	var valid []string
+	var errs []error
+	for _, domain := range strings.Split(domains, ",") {
+		domain = strings.TrimSpace(domain)
+		if domain == "" {
+			continue
+		}
+		if err := validateExternalDomain(domain); err != nil {
+			errs = append(errs, fmt.Errorf("invalid external domain '%s' for service %s in %s: %s", domain, s.Name, s.Namespace, err))
+			continue
+		}
+		valid = append(valid, domain)
+	}
+	return valid, errs
+}
+
+func (v ExternalDomainsValidator) ValidateService(s *v1.Service) error {
+	if _, errs := v.ExternalDomains(s); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func validateExternalDomain(domain string) error {
+	if strings.ContainsAny(domain, " \t\r\n") {
+		return fmt.Errorf("it cannot contain spaces")
+	}
+
+	var errs []string
+	switch {
+	case strings.HasPrefix(domain, "~"):
+		expr := strings.TrimPrefix(domain, "~")
+		if expr == "" {
+			return fmt.Errorf("empty regular expression")
+		}
+		if _, err := regexp.Compile(expr); err != nil {
+			return err
+		}
+		return nil
+	case strings.HasPrefix(domain, "*"):
+		errs = validation.IsWildcardDNS1123Subdomain(strings.ToLower(domain))
+	default:
+		errs = validation.IsDNS1123Subdomain(strings.ToLower(domain))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
 }
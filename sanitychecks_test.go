@@ -18,6 +18,8 @@ package main
 
 import (
 	"net"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -277,3 +279,226 @@ func TestSanityCheckLBAddressDontCheckLocalBind(t *testing.T) {
 		}
 	}
 }
+
+func TestExternalDomainsValidator(t *testing.T) {
+	cases := []struct {
+		domains string
+		valid   []string
+		invalid int
+	}{
+		{"", nil, 0},
+		{"example.com,www.example.com", []string{"example.com", "www.example.com"}, 0},
+		{"example.com, Example.org ,", []string{"example.com", "Example.org"}, 0},
+		{"*.example.com,*example.com,foo.*.com", []string{"*.example.com"}, 2},
+		{"~^(www\\.)?example\\.com$,~^(www\\.example\\.com$,~", []string{"~^(www\\.)?example\\.com$"}, 2},
+		{"exam ple.com,-example.com,example_.com,example.com", []string{"example.com"}, 3},
+		{"~^example.com$ ", []string{"~^example.com$"}, 0},
+		{"~^example .com$", nil, 1},
+	}
+
+	v := ExternalDomainsValidator{}
+	for _, c := range cases {
+		s := &v1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:        "service1",
+				Namespace:   "test",
+				Annotations: map[string]string{ExternalDomainsAnnotation: c.domains},
+			},
+		}
+		valid, errs := v.ExternalDomains(s)
+		if !reflect.DeepEqual(c.valid, valid) {
+			t.Errorf("Valid domains for '%s': expected %v, found %v", c.domains, c.valid, valid)
+		}
+		if len(errs) != c.invalid {
+			t.Errorf("Expected %d errors for '%s', found %v", c.invalid, c.domains, errs)
+		}
+		if err := v.ValidateService(s); (err != nil) != (c.invalid > 0) {
+			t.Errorf("Unexpected validation result for '%s': %v", c.domains, err)
+		}
+	}
+}
+
+func TestNewSanityChecks(t *testing.T) {
+	checks, err := newSanityChecks("privileged-ports, lb-ip-cidrs, external-domains,")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(checks) != 3 {
+		t.Fatalf("Expected 3 checks, found %d", len(checks))
+	}
+
+	checks, err = newSanityChecks("")
+	if err != nil || len(checks) != 0 {
+		t.Fatalf("No checks expected with empty list, found %v (%v)", checks, err)
+	}
+
+	if _, err := newSanityChecks("ephemeral-ports,unknown"); err == nil {
+		t.Fatalf("Unknown checks should fail")
+	}
+}
+
+func sanityCheckService(serviceType v1.ServiceType, lbIP string, ports ...int32) *v1.Service {
+	s := &v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "service1", Namespace: "test"},
+		Spec: v1.ServiceSpec{
+			Type:           serviceType,
+			LoadBalancerIP: lbIP,
+		},
+	}
+	for _, port := range ports {
+		s.Spec.Ports = append(s.Spec.Ports, v1.ServicePort{Port: port, Protocol: v1.ProtocolTCP})
+	}
+	return s
+}
+
+func TestPrivilegedPorts(t *testing.T) {
+	check := PrivilegedPorts{check: true, UnprivilegedPortStart: 1024}
+	if err := check.ValidateService(sanityCheckService(v1.ServiceTypeNodePort, "", 8080, 443)); err == nil {
+		t.Fatalf("Privileged port should fail")
+	}
+	if err := check.ValidateService(sanityCheckService(v1.ServiceTypeNodePort, "", 8080, 1024)); err != nil {
+		t.Fatalf("Unprivileged ports shouldn't fail: %s", err)
+	}
+
+	check = PrivilegedPorts{check: true, UnprivilegedPortStart: 80}
+	if err := check.ValidateService(sanityCheckService(v1.ServiceTypeNodePort, "", 80, 443)); err != nil {
+		t.Fatalf("Ports over the unprivileged port start shouldn't fail: %s", err)
+	}
+
+	check = PrivilegedPorts{check: false}
+	if err := check.ValidateService(sanityCheckService(v1.ServiceTypeNodePort, "", 443)); err != nil {
+		t.Fatalf("Disabled check shouldn't fail: %s", err)
+	}
+}
+
+func TestHasEffectiveCapability(t *testing.T) {
+	cases := []struct {
+		status   string
+		expected bool
+	}{
+		{"Name:\tkube2lb\nCapInh:\t0000000000000400\nCapEff:\t0000000000000000\n", false},
+		{"Name:\tkube2lb\nCapEff:\t0000000000000400\n", true},
+		{"Name:\tkube2lb\nCapEff:\t000001ffffffffff\n", true},
+		{"Name:\tkube2lb\nCapEff:\tinvalid\n", false},
+		{"Name:\tkube2lb\n", false},
+	}
+	for _, c := range cases {
+		if found := hasEffectiveCapability(strings.NewReader(c.status), capNetBindService); found != c.expected {
+			t.Errorf("Expected %v for status %q, found %v", c.expected, c.status, found)
+		}
+	}
+}
+
+func TestOwnListeners(t *testing.T) {
+	oldMetricsAddress, oldACMEDirectoryURL, oldXDSServerAddress := metricsAddress, acmeDirectoryURL, xdsServerAddress
+	defer func() {
+		metricsAddress, acmeDirectoryURL, xdsServerAddress = oldMetricsAddress, oldACMEDirectoryURL, oldXDSServerAddress
+	}()
+	metricsAddress = ":9090"
+	acmeDirectoryURL = "https://acme.example.com/directory"
+	xdsServerAddress = "10.0.0.2:8081"
+
+	check, err := initOwnListenersCheck()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	cases := []struct {
+		service *v1.Service
+		fails   bool
+	}{
+		{sanityCheckService(v1.ServiceTypeNodePort, "", 80), false},
+		{sanityCheckService(v1.ServiceTypeNodePort, "", 9090), true},
+		{sanityCheckService(v1.ServiceTypeLoadBalancer, "10.0.0.1", 9090), true},
+		{sanityCheckService(v1.ServiceTypeNodePort, "", 8402), true},
+		{sanityCheckService(v1.ServiceTypeLoadBalancer, "10.0.0.1", 8402), false},
+		{sanityCheckService(v1.ServiceTypeLoadBalancer, "127.0.0.1", 8402), true},
+		{sanityCheckService(v1.ServiceTypeNodePort, "", 8081), true},
+		{sanityCheckService(v1.ServiceTypeLoadBalancer, "10.0.0.2", 8081), true},
+		{sanityCheckService(v1.ServiceTypeLoadBalancer, "10.0.0.1", 8081), false},
+	}
+	for i, c := range cases {
+		if err := check.ValidateService(c.service); (err != nil) != c.fails {
+			t.Errorf("Case %d: unexpected result %v", i, err)
+		}
+	}
+
+	udp := sanityCheckService(v1.ServiceTypeNodePort, "", 9090)
+	udp.Spec.Ports[0].Protocol = v1.ProtocolUDP
+	if err := check.ValidateService(udp); err != nil {
+		t.Errorf("UDP ports shouldn't collide with TCP listeners: %s", err)
+	}
+}
+
+func TestLoadBalancerIPCIDRs(t *testing.T) {
+	if _, err := initLoadBalancerIPCIDRsCheck("10.0.0.0/8,foo"); err == nil {
+		t.Fatalf("Invalid CIDR should fail")
+	}
+
+	check, err := initLoadBalancerIPCIDRsCheck("10.0.0.0/8, 192.168.1.0/24")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	cases := []struct {
+		service *v1.Service
+		fails   bool
+	}{
+		{sanityCheckService(v1.ServiceTypeNodePort, "", 80), false},
+		{sanityCheckService(v1.ServiceTypeLoadBalancer, "", 80), false},
+		{sanityCheckService(v1.ServiceTypeLoadBalancer, "10.1.2.3", 80), false},
+		{sanityCheckService(v1.ServiceTypeLoadBalancer, "192.168.1.10", 80), false},
+		{sanityCheckService(v1.ServiceTypeLoadBalancer, "192.168.2.10", 80), true},
+		{sanityCheckService(v1.ServiceTypeLoadBalancer, "foo", 80), true},
+	}
+	for i, c := range cases {
+		if err := check.ValidateService(c.service); (err != nil) != c.fails {
+			t.Errorf("Case %d: unexpected result %v", i, err)
+		}
+	}
+
+	// IPs allocated from pools are also checked
+	oldPools := lbIPPoolsArg
+	defer func() { lbIPPoolsArg = oldPools }()
+	lbIPPoolsArg = "192.168.2.10-192.168.2.20"
+	allocated := sanityCheckService(v1.ServiceTypeLoadBalancer, "", 80)
+	allocated.Annotations = map[string]string{AllocatedIPAnnotation: "192.168.2.10"}
+	if err := check.ValidateService(allocated); err == nil {
+		t.Errorf("Allocated IP out of allowed networks should fail")
+	}
+
+	check, _ = initLoadBalancerIPCIDRsCheck("")
+	if err := check.ValidateService(sanityCheckService(v1.ServiceTypeLoadBalancer, "192.168.2.10", 80)); err != nil {
+		t.Fatalf("Any IP should be allowed without CIDRs: %s", err)
+	}
+}
+
+func TestSanityCheckLBAddressIPv6(t *testing.T) {
+	a := AddressForLoadBalancerIP{
+		checkLocalBind:     false,
+		checkLocalBindIPv6: true,
+		addressesTime:      time.Now(),
+		interfaceAddresses: []net.Addr{
+			&net.IPNet{IP: net.ParseIP("::1")},
+			&net.IPNet{IP: net.ParseIP("fd00::1")},
+		},
+	}
+
+	cases := []struct {
+		ip         string
+		expectedOk bool
+	}{
+		{"fd00::1", true},
+		{"fd00::2", false},
+		{"10.0.0.1", true},
+	}
+	for _, c := range cases {
+		err := a.ValidateService(sanityCheckService(v1.ServiceTypeLoadBalancer, c.ip, 80))
+		if c.expectedOk && err != nil {
+			t.Errorf("Unexpected error for %s: %s", c.ip, err)
+		}
+		if !c.expectedOk && err == nil {
+			t.Errorf("Expected failure for %s", c.ip)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs contains the functions available to all templates, they are
+// documented in docs/template_functions.md
+var templateFuncs = template.FuncMap{
+	"EscapeNode":  nodeNameReplacer.Replace,
+	"IntRange":    intRange,
+	"ServerNames": generateServerNames,
+	"ToLower":     strings.ToLower,
+	"ToUpper":     strings.ToUpper,
+	"Add":         opAdd,
+
+	"IngressBackends": ingressBackends,
+	"IngressRoutes":   ingressRoutes,
+	"PathRoutes":      pathRoutes,
+
+	"PortCertificates":    portCertificates,
+	"IngressCertificates": ingressCertificates,
+
+	"ParseJSON":      parseJSON,
+	"PortAnnotation": portAnnotation,
+
+	"IsIPv6":       isIPv6,
+	"BracketIP":    bracketIP,
+	"JoinHostPort": joinHostPort,
+
+	"VirtualServerIPs":    virtualServerIPs,
+	"EndpointRealServers": endpointRealServers,
+	"NodeRealServers":     nodeRealServers,
+	"LVSScheduler":        lvsScheduler,
+	"DelayLoop":           delayLoop,
+
+	"NginxName":         nginxName,
+	"NginxQuote":        nginxQuote,
+	"NginxServerName":   nginxServerName,
+	"NginxListen":       nginxListen,
+	"NginxBalance":      nginxBalance,
+	"NginxVirtualHosts": nginxVirtualHosts,
+
+	"Join":       join,
+	"Split":      split,
+	"Replace":    replace,
+	"Contains":   contains,
+	"HasPrefix":  hasPrefix,
+	"HasSuffix":  hasSuffix,
+	"TrimSpace":  strings.TrimSpace,
+	"TrimPrefix": trimPrefix,
+	"TrimSuffix": trimSuffix,
+
+	"Default": defaultValue,
+
+	"RegexpQuote":   regexp.QuoteMeta,
+	"RegexpMatch":   regexpMatch,
+	"RegexpReplace": regexpReplace,
+
+	"Dict": dict,
+	"List": list,
+
+	"SortServices":             sortServices,
+	"GroupServicesByPort":      groupServicesByPort,
+	"GroupServicesByNamespace": groupServicesByNamespace,
+
+	"ToJSON": toJSON,
+	"Env":    templateEnv,
+	"Hash":   hash,
+}
+
+var nodeNameReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+func intRange(n, initial, step int) chan int {
+	c := make(chan int)
+	go func() {
+		for i := 0; i < n; i++ {
+			c <- initial + i*step
+		}
+		close(c)
+	}()
+	return c
+}
+
+func opAdd(ns ...int) int {
+	r := 0
+	for _, n := range ns {
+		r += n
+	}
+	return r
+}
+
+// Functions with more than one argument receive the value they operate on as
+// last argument, so they can be used in pipelines, e.g:
+// {{ .External | Join "," }}
+
+// toStrings converts a slice or array of any type to a slice of strings
+func toStrings(values interface{}) ([]string, error) {
+	v := reflect.ValueOf(values)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+	default:
+		return nil, fmt.Errorf("expected a list, found %T", values)
+	}
+	s := make([]string, v.Len())
+	for i := range s {
+		s[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return s, nil
+}
+
+func join(sep string, values interface{}) (string, error) {
+	s, err := toStrings(values)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(s, sep), nil
+}
+
+func split(sep, s string) []string {
+	return strings.Split(s, sep)
+}
+
+func replace(old, new, s string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+func contains(substr, s string) bool {
+	return strings.Contains(s, substr)
+}
+
+func hasPrefix(prefix, s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+func hasSuffix(suffix, s string) bool {
+	return strings.HasSuffix(s, suffix)
+}
+
+func trimPrefix(prefix, s string) string {
+	return strings.TrimPrefix(s, prefix)
+}
+
+func trimSuffix(suffix, s string) string {
+	return strings.TrimSuffix(s, suffix)
+}
+
+// defaultValue returns the value, or the default if the value is empty, as
+// considered by the if action
+func defaultValue(def, value interface{}) interface{} {
+	if isEmpty(value) {
+		return def
+	}
+	return value
+}
+
+func isEmpty(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func regexpMatch(pattern, s string) (bool, error) {
+	return regexp.MatchString(pattern, s)
+}
+
+func regexpReplace(pattern, repl, s string) (string, error) {
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return r.ReplaceAllString(s, repl), nil
+}
+
+// dict builds a map from a list of keys and values
+func dict(values ...interface{}) (map[string]interface{}, error) {
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("expected pairs of keys and values, found %d arguments", len(values))
+	}
+	d := make(map[string]interface{}, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		key, ok := values[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("keys must be strings, found %T", values[i])
+		}
+		d[key] = values[i+1]
+	}
+	return d, nil
+}
+
+func list(values ...interface{}) []interface{} {
+	return values
+}
+
+// sortServices returns the services sorted by namespace, name and port, to
+// generate configurations that don't change if services don't change
+func sortServices(services []ServiceInformation) []ServiceInformation {
+	sorted := make([]ServiceInformation, len(services))
+	copy(sorted, services)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Port.String() < b.Port.String()
+	})
+	return sorted
+}
+
+// PortServices is a port with the services using it
+type PortServices struct {
+	Port     PortSpec
+	Services []ServiceInformation
+}
+
+// groupServicesByPort groups services by port, groups are sorted by port
+// number and services in each group are sorted
+func groupServicesByPort(services []ServiceInformation) []PortServices {
+	var groups []PortServices
+	index := make(map[string]int)
+	for _, s := range sortServices(services) {
+		key := s.Port.String()
+		i, found := index[key]
+		if !found {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, PortServices{Port: s.Port})
+		}
+		groups[i].Services = append(groups[i].Services, s)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i].Port, groups[j].Port
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.String() < b.String()
+	})
+	return groups
+}
+
+// NamespaceServices is a namespace with its services
+type NamespaceServices struct {
+	Namespace string
+	Services  []ServiceInformation
+}
+
+// groupServicesByNamespace groups services by namespace, groups and
+// services in each group are sorted
+func groupServicesByNamespace(services []ServiceInformation) []NamespaceServices {
+	var groups []NamespaceServices
+	for _, s := range sortServices(services) {
+		if n := len(groups); n == 0 || groups[n-1].Namespace != s.Namespace {
+			groups = append(groups, NamespaceServices{Namespace: s.Namespace})
+		}
+		groups[len(groups)-1].Services = append(groups[len(groups)-1].Services, s)
+	}
+	return groups
+}
+
+func toJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// templateEnvPrefix is the prefix of the environment variables that can be
+// read from templates, so other variables of the process, as credentials, are
+// not exposed
+const templateEnvPrefix = "KUBE2LB_"
+
+// templateEnv returns the value of an environment variable, only variables
+// with templateEnvPrefix can be read
+func templateEnv(name string) (string, error) {
+	if !strings.HasPrefix(name, templateEnvPrefix) {
+		return "", fmt.Errorf("cannot read environment variable %s, only variables with prefix %s can be used in templates", name, templateEnvPrefix)
+	}
+	return os.Getenv(name), nil
+}
+
+// hash returns a short hash of a value, it can be used to generate stable
+// labels of limited length. Strings are hashed as they are, other values are
+// hashed by their JSON encoding, so pointers are followed instead of being
+// hashed by address
+func hash(value interface{}) (string, error) {
+	data, ok := value.(string)
+	if !ok {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", fmt.Errorf("cannot hash value: %v", err)
+		}
+		data = string(encoded)
+	}
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:4]), nil
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func executeTestTemplate(source string, data interface{}) (string, error) {
+	t, err := template.New("test").Funcs(templateFuncs).Parse(source)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	err = t.Execute(&b, data)
+	return b.String(), err
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	os.Setenv("KUBE2LB_TEST_ENV", "foo")
+	defer os.Unsetenv("KUBE2LB_TEST_ENV")
+
+	data := map[string]interface{}{
+		"names": []string{"a", "b", "c"},
+		"ips":   []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+		"empty": "",
+		"zero":  0,
+		"port":  PortSpec{IP: net.IPv4zero, Port: 80, Protocol: "tcp", Mode: "http"},
+	}
+
+	cases := []struct {
+		source   string
+		expected string
+	}{
+		{`{{ .names | Join "," }}`, "a,b,c"},
+		{`{{ .ips | Join " " }}`, "10.0.0.1 fd00::1"},
+		{`{{ range Split "," "x,y" }}[{{ . }}]{{ end }}`, "[x][y]"},
+		{`{{ "a.b.c" | Replace "." "_" }}`, "a_b_c"},
+		{`{{ Contains "b" "abc" }} {{ HasPrefix "a" "abc" }} {{ HasSuffix "a" "abc" }}`, "true true false"},
+		{`{{ TrimSpace "  a " }}|{{ TrimPrefix "/" "/a" }}|{{ TrimSuffix "/" "a/" }}`, "a|a|a"},
+		{`{{ .empty | Default "none" }} {{ .zero | Default 5 }} {{ .missing | Default "x" }} {{ "a" | Default "b" }}`, "none 5 x a"},
+		{`{{ RegexpQuote "a.b*" }}`, `a\.b\*`},
+		{`{{ RegexpMatch "^a+$" "aaa" }} {{ "a-1" | RegexpReplace "[^a-z]" "_" }}`, "true a__"},
+		{`{{ $d := Dict "a" 1 "b" "x" }}{{ $d.a }} {{ $d.b }}`, "1 x"},
+		{`{{ range List 1 "a" true }}{{ . }} {{ end }}`, "1 a true "},
+		{`{{ Dict "a" (List 1 2) | ToJSON }}`, `{"a":[1,2]}`},
+		{`{{ Env "KUBE2LB_TEST_ENV" }}{{ Env "KUBE2LB_TEST_UNDEFINED" }}`, "foo"},
+		{`{{ Hash .port.String }} {{ Hash "00000000_80_tcp_http" }}`, "6f8bbc50 6f8bbc50"},
+		{`{{ EscapeNode "node-1.example.com" }} {{ Add 1 2 3 }}`, "node-1_example_com 6"},
+	}
+
+	for _, c := range cases {
+		result, err := executeTestTemplate(c.source, data)
+		if assert.NoError(t, err, c.source) {
+			assert.Equal(t, c.expected, result, c.source)
+		}
+	}
+
+	for _, source := range []string{
+		`{{ Dict "a" }}`,
+		`{{ Dict 1 2 }}`,
+		`{{ "a" | Join "," }}`,
+		`{{ RegexpMatch "(" "a" }}`,
+		`{{ ToJSON .func }}`,
+		`{{ Hash .func }}`,
+		`{{ Env "HOME" }}`,
+	} {
+		_, err := executeTestTemplate(source, map[string]interface{}{"func": func() {}})
+		assert.Error(t, err, source)
+	}
+}
+
+func TestHashFollowsPointers(t *testing.T) {
+	newService := func() ServiceInformation {
+		return ServiceInformation{
+			Name:            "web",
+			Namespace:       "default",
+			HealthCheck:     &HealthCheck{Path: "/health"},
+			SessionAffinity: &SessionAffinityInformation{ClientIP: true},
+		}
+	}
+
+	first, err := hash(newService())
+	assert.NoError(t, err)
+	second, err := hash(newService())
+	assert.NoError(t, err)
+	assert.Equal(t, first, second, "copies with different pointers should have the same hash")
+
+	changed := newService()
+	changed.HealthCheck.Path = "/ready"
+	third, err := hash(changed)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, third, "pointed values should be hashed")
+}
+
+func TestServicesSortingAndGrouping(t *testing.T) {
+	http := PortSpec{IP: net.IPv4zero, Port: 80, Protocol: "tcp", Mode: "http"}
+	tcp := PortSpec{IP: net.IPv4zero, Port: 5432, Protocol: "tcp", Mode: "tcp"}
+	udp := PortSpec{IP: net.IPv4zero, Port: 53, Protocol: "udp"}
+	services := []ServiceInformation{
+		{Name: "web", Namespace: "b", Port: http},
+		{Name: "db", Namespace: "b", Port: tcp},
+		{Name: "web", Namespace: "a", Port: http},
+		{Name: "dns", Namespace: "a", Port: udp},
+	}
+
+	var names []string
+	for _, s := range sortServices(services) {
+		names = append(names, s.Namespace+"/"+s.Name)
+	}
+	assert.Equal(t, []string{"a/dns", "a/web", "b/db", "b/web"}, names)
+	assert.Equal(t, "web", services[0].Name, "original list shouldn't be modified")
+
+	byPort := groupServicesByPort(services)
+	if assert.Len(t, byPort, 3) {
+		assert.Equal(t, udp, byPort[0].Port)
+		assert.Equal(t, http, byPort[1].Port)
+		assert.Len(t, byPort[1].Services, 2)
+		assert.Equal(t, "a", byPort[1].Services[0].Namespace)
+		assert.Equal(t, tcp, byPort[2].Port)
+	}
+
+	byNamespace := groupServicesByNamespace(services)
+	if assert.Len(t, byNamespace, 2) {
+		assert.Equal(t, "a", byNamespace[0].Namespace)
+		assert.Len(t, byNamespace[0].Services, 2)
+		assert.Equal(t, "b", byNamespace[1].Namespace)
+		assert.Len(t, byNamespace[1].Services, 2)
+	}
+}
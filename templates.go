@@ -18,22 +18,35 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
 	"os"
-	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
 )
 
 var defaultServerNameTemplate = "{{ .Service.Name }}.{{ .Service.Namespace }}.svc.{{ .Domain }}"
 var serverNameTemplatesArg string
 var serverNameTemplates []*template.Template
+var templateEntry string
+var templateCheckInterval = 5 * time.Second
 
 func init() {
 	flag.StringVar(&serverNameTemplatesArg, "server-name-templates", defaultServerNameTemplate, "Comma-separated list of go templates to generate server names")
+	flag.DurationVar(&templateCheckInterval, "template-check-interval", templateCheckInterval, "Interval between checks for changes in template files, disabled if zero")
+	flag.StringVar(&templateEntry, "template-entry", "", "Base name of the template file to execute, needed if the template is a directory or a pattern with several files")
 }
 
 type serverName string
@@ -71,7 +84,13 @@ func initServerNameTemplates() (err error) {
 }
 
 type PortSpec struct {
-	IP       net.IP
+	// IP is the main IP of the port, used to identify it
+	IP net.IP
+
+	// IPs contains all the IPs where the port is exposed, it has more than
+	// one element for dual-stack ports
+	IPs []net.IP
+
 	Port     int32
 	Mode     string
 	Protocol string
@@ -93,10 +112,29 @@ type ServiceInformation struct {
 	Name      string
 	Namespace string
 	Port      PortSpec
+	PortName  string
 	Endpoints []ServiceEndpoint
 	NodePort  int32
 	External  []string
 	Timeout   int
+	Paths     []PathRule
+	TLS       *TLSInformation
+
+	Balance        string
+	MaxConnections int
+	HealthCheck    *HealthCheck
+
+	SessionAffinity *SessionAffinityInformation
+	TrafficSplit    *TrafficSplitInformation
+
+	ExternalName string
+	Resolution   string
+
+	Annotations map[string]string
+	Labels      map[string]string
+
+	// Service this information was obtained from
+	source *v1.Service
 }
 
 // String representation of a Service, intended to be used as config label
@@ -106,24 +144,212 @@ func (s ServiceInformation) String() string {
 }
 
 type ClusterInformation struct {
-	Services []ServiceInformation
-	Ports    []PortSpec
-	Nodes    []string
-	Domain   string
+	Services  []ServiceInformation
+	Ports     []PortSpec
+	Ingresses []IngressInformation
+	Nodes     []string
+	Domain    string
+
+	ACMEHTTPAddress string
 }
 
 type Template interface {
 	Execute(info *ClusterInformation) error
 }
 
+// WatchedTemplate is a template that can notify when its source changes
+type WatchedTemplate interface {
+	Template
+	Watch(ctx context.Context, notify func())
+}
+
+// templateFile is a template whose source can be a file, a directory or a
+// glob pattern, templates in all files can be used from the entry template
 type templateFile struct {
 	Source, Path string
+
+	// Entry is the base name of the file executed, it can be empty if
+	// the source has a single file
+	Entry string
+
+	cache templateCache
 }
 
 func NewTemplate(source, path string) Template {
 	return &templateFile{
 		Source: source,
 		Path:   path,
+		Entry:  templateEntry,
+	}
+}
+
+// templateSources returns the files of a template source, that can be a
+// file, a directory or a glob pattern. Hidden files are ignored.
+func templateSources(source string) ([]string, error) {
+	info, err := os.Stat(source)
+	if err == nil && !info.IsDir() {
+		return []string{source}, nil
+	}
+
+	var candidates []string
+	if err == nil {
+		entries, err := ioutil.ReadDir(source)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			candidates = append(candidates, filepath.Join(source, entry.Name()))
+		}
+	} else {
+		candidates, err = filepath.Glob(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template pattern %s: %s", source, err)
+		}
+	}
+
+	var files []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(filepath.Base(candidate), ".") {
+			continue
+		}
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			files = append(files, candidate)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no template files found in %s", source)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// templateFingerprint returns a string that changes if any of the files
+// changes, content is also hashed as modification times can have a coarse
+// resolution and edits can keep the size
+func templateFingerprint(files []string) (string, error) {
+	var fingerprint bytes.Buffer
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(content)
+		fmt.Fprintf(&fingerprint, "%s %d %d %s\n", file, info.Size(), info.ModTime().UnixNano(), hex.EncodeToString(sum[:]))
+	}
+	return fingerprint.String(), nil
+}
+
+// templateEntryName returns the name of the template to execute, files
+// are parsed as templates named as their base names
+func templateEntryName(files []string, entry string) (string, error) {
+	names := make(map[string]bool)
+	for _, file := range files {
+		name := filepath.Base(file)
+		if names[name] {
+			return "", fmt.Errorf("found several template files named %s", name)
+		}
+		names[name] = true
+	}
+	switch {
+	case entry != "":
+		if !names[entry] {
+			return "", fmt.Errorf("entry template %s not found", entry)
+		}
+		return entry, nil
+	case len(files) == 1:
+		return filepath.Base(files[0]), nil
+	default:
+		return "", fmt.Errorf("entry template must be declared with -template-entry if there are several template files")
+	}
+}
+
+// templateCache keeps the last valid version of a template, so errors in new
+// versions don't break the generated configuration
+type templateCache struct {
+	sync.Mutex
+	parsed  *template.Template
+	version string
+
+	failedVersion string
+	failedErr     error
+}
+
+// get returns the template for a version, it is parsed only if the version
+// changes, and the last valid template is returned if it cannot be parsed.
+// Errors obtaining the version can be passed as err to keep the last valid
+// template. changed is true if a new version has been parsed.
+func (c *templateCache) get(name, version string, err error, parse func() (*template.Template, error)) (s *template.Template, changed bool, _ error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if err != nil {
+		// Errors are used as versions so they are only reported once
+		version = err.Error()
+	}
+	if c.parsed != nil && version == c.version {
+		return c.parsed, false, nil
+	}
+	if version != c.failedVersion {
+		if err == nil {
+			s, err = parse()
+			if err == nil {
+				c.parsed, c.version = s, version
+				c.failedVersion, c.failedErr = "", nil
+				return s, true, nil
+			}
+		}
+		c.failedVersion, c.failedErr = version, err
+		if c.parsed != nil {
+			log.Printf("Couldn't load template %s, using last valid version: %s", name, err)
+		}
+	}
+	if c.parsed == nil {
+		return nil, false, c.failedErr
+	}
+	return c.parsed, false, nil
+}
+
+// load returns the parsed template, files are only parsed again if any of
+// them changes. changed is true if a new version has been parsed.
+func (t *templateFile) load() (s *template.Template, changed bool, err error) {
+	files, err := templateSources(t.Source)
+	var fingerprint string
+	if err == nil {
+		fingerprint, err = templateFingerprint(files)
+	}
+	return t.cache.get(t.Source, fingerprint, err, func() (*template.Template, error) {
+		entryName, err := templateEntryName(files, t.Entry)
+		if err != nil {
+			return nil, err
+		}
+		// Files are associated to templates named as their base names,
+		// so the entry file is the one executed
+		return template.New(entryName).Funcs(templateFuncs).ParseFiles(files...)
+	})
+}
+
+// Watch checks periodically if the template changes, and calls notify when
+// a new valid version is found
+func (t *templateFile) Watch(ctx context.Context, notify func()) {
+	if templateCheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(templateCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, changed, _ := t.load(); changed {
+				log.Printf("Template %s changed", t.Source)
+				notify()
+			}
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -159,50 +385,39 @@ func generateServerNames(s ServiceInformation, domain string) []serverName {
 	}()
 }
 
-var nodeNameReplacer = strings.NewReplacer(".", "_", ":", "_")
-
-func intRange(n, initial, step int) chan int {
-	c := make(chan int)
-	go func() {
-		for i := 0; i < n; i++ {
-			c <- initial + i*step
-		}
-		close(c)
-	}()
-	return c
+func isIPv6(ip net.IP) bool {
+	return ip != nil && ip.To4() == nil
 }
 
-func opAdd(ns ...int) int {
-	r := 0
-	for _, n := range ns {
-		r += n
+// bracketIP formats an IP so it can be followed by a port, IPv6 addresses
+// are enclosed in brackets
+func bracketIP(ip net.IP) string {
+	if isIPv6(ip) {
+		return "[" + ip.String() + "]"
 	}
-	return r
+	return ip.String()
 }
 
-func (t *templateFile) Execute(info *ClusterInformation) error {
-	funcMap := template.FuncMap{
-		"EscapeNode":  nodeNameReplacer.Replace,
-		"IntRange":    intRange,
-		"ServerNames": generateServerNames,
-		"ToLower":     strings.ToLower,
-		"ToUpper":     strings.ToUpper,
-		"Add":         opAdd,
-	}
+// joinHostPort formats a host and a port as an address, IPv6 addresses are
+// enclosed in brackets
+func joinHostPort(host, port interface{}) string {
+	return net.JoinHostPort(fmt.Sprint(host), fmt.Sprint(port))
+}
 
-	// template.Execute will use the base name of t.Source
-	s, err := template.New(path.Base(t.Source)).Funcs(funcMap).ParseFiles(t.Source)
-	if err != nil {
-		return err
-	}
-	f, err := os.OpenFile(t.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+func (t *templateFile) Execute(info *ClusterInformation) error {
+	s, _, err := t.load()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	return writeConfig(s, t.Path, info)
+}
 
-	if err = s.Execute(f, info); err != nil {
+// writeConfig executes a template and writes the result, the configuration
+// is only written if the template can be executed
+func writeConfig(s *template.Template, path string, info *ClusterInformation) error {
+	var config bytes.Buffer
+	if err := s.Execute(&config, info); err != nil {
 		return err
 	}
-	return nil
+	return ioutil.WriteFile(path, config.Bytes(), 0644)
 }
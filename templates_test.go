@@ -0,0 +1,335 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "Update golden files in testdata")
+
+// assertGolden executes a template source and compares the result with the
+// content of a golden file, golden files are updated with -update-golden
+func assertGolden(t *testing.T, source string, info *ClusterInformation, golden string) {
+	dir, err := ioutil.TempDir("", "kube2lb-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	templatePath := filepath.Join(dir, filepath.Base(golden)+".tpl")
+	if err := ioutil.WriteFile(templatePath, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, filepath.Base(golden))
+	if err := NewTemplate(templatePath, configPath).Execute(info); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, config, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(expected), string(config), golden)
+}
+
+func TestPortSpecString(t *testing.T) {
+	cases := []struct {
+		port     PortSpec
+		expected string
+	}{
+		{PortSpec{IP: net.IPv4zero, Port: 80, Protocol: "tcp", Mode: "http"}, "00000000_80_tcp_http"},
+		{PortSpec{IP: net.ParseIP("10.0.0.1"), Port: 80, Protocol: "tcp", Mode: "http"}, "0a000001_80_tcp_http"},
+		{PortSpec{IP: net.IPv6zero, Port: 80, Protocol: "tcp", Mode: "http"}, "00000000000000000000000000000000_80_tcp_http"},
+		{PortSpec{IP: net.ParseIP("fd00::1"), Port: 443, Protocol: "tcp", Mode: "tcp"}, "fd000000000000000000000000000001_443_tcp_tcp"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, c.port.String())
+	}
+}
+
+func TestIPv6Helpers(t *testing.T) {
+	assert.False(t, isIPv6(net.ParseIP("10.0.0.1")))
+	assert.True(t, isIPv6(net.ParseIP("fd00::1")))
+	assert.False(t, isIPv6(nil))
+
+	assert.Equal(t, "10.0.0.1", bracketIP(net.ParseIP("10.0.0.1")))
+	assert.Equal(t, "[fd00::1]", bracketIP(net.ParseIP("fd00::1")))
+	assert.Equal(t, "[::]", bracketIP(net.IPv6zero))
+
+	assert.Equal(t, "10.0.0.1:80", joinHostPort(net.ParseIP("10.0.0.1"), int32(80)))
+	assert.Equal(t, "[fd00::1]:80", joinHostPort(net.ParseIP("fd00::1"), 80))
+	assert.Equal(t, "[fd00::1]:80", joinHostPort("fd00::1", "80"))
+	assert.Equal(t, "example.com:80", joinHostPort("example.com", 80))
+
+	endpoint := ServiceEndpoint{Hostname: "example.com", Port: 80}
+	assert.Equal(t, "example.com:80", endpoint.HostPort())
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTemplateSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFiles(t, dir, map[string]string{
+		"main.tpl":     "",
+		"backends.tpl": "",
+		"global.inc":   "",
+		".main.tpl.sw": "",
+	})
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		source string
+		files  []string
+	}{
+		{filepath.Join(dir, "main.tpl"), []string{"main.tpl"}},
+		{dir, []string{"backends.tpl", "global.inc", "main.tpl"}},
+		{filepath.Join(dir, "*.tpl"), []string{"backends.tpl", "main.tpl"}},
+		{filepath.Join(dir, "*"), []string{"backends.tpl", "global.inc", "main.tpl"}},
+		{filepath.Join(dir, "notexists.tpl"), nil},
+		{filepath.Join(dir, "*.notexists"), nil},
+		{filepath.Join(dir, "[.tpl"), nil},
+	}
+	for _, c := range cases {
+		files, err := templateSources(c.source)
+		if c.files == nil {
+			assert.Error(t, err, c.source)
+			continue
+		}
+		var names []string
+		for _, file := range files {
+			names = append(names, filepath.Base(file))
+		}
+		if assert.NoError(t, err, c.source) {
+			assert.Equal(t, c.files, names, c.source)
+		}
+	}
+
+	entry, err := templateEntryName([]string{"a/main.tpl"}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "main.tpl", entry)
+	_, err = templateEntryName([]string{"a/main.tpl", "a/backends.tpl"}, "")
+	assert.Error(t, err, "entry is needed with several files")
+	_, err = templateEntryName([]string{"a/main.tpl", "a/backends.tpl"}, "other.tpl")
+	assert.Error(t, err, "entry must exist")
+	_, err = templateEntryName([]string{"a/main.tpl", "b/main.tpl"}, "main.tpl")
+	assert.Error(t, err, "base names must be unique")
+}
+
+func TestTemplateDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourceDir := filepath.Join(dir, "templates")
+	if err := os.Mkdir(sourceDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, sourceDir, map[string]string{
+		"main.tpl":     `{{ template "global" . }}{{ range .Services }}{{ template "backend" . }}{{ end }}`,
+		"global.tpl":   `{{ define "global" }}domain {{ .Domain }}{{ "\n" }}{{ end }}`,
+		"backends.tpl": `{{ define "backend" }}backend {{ .Name }}{{ "\n" }}{{ end }}`,
+	})
+
+	configPath := filepath.Join(dir, "config")
+	tpl := &templateFile{Source: sourceDir, Path: configPath, Entry: "main.tpl"}
+	info := &ClusterInformation{
+		Domain:   "cluster.local",
+		Services: []ServiceInformation{{Name: "a"}, {Name: "b"}},
+	}
+
+	assertConfig := func(expected string) {
+		if err := tpl.Execute(info); err != nil {
+			t.Fatal(err)
+		}
+		config, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, string(config))
+	}
+
+	assertConfig("domain cluster.local\nbackend a\nbackend b\n")
+	parsed := tpl.cache.parsed
+
+	assertConfig("domain cluster.local\nbackend a\nbackend b\n")
+	assert.True(t, parsed == tpl.cache.parsed, "template shouldn't be parsed again if files don't change")
+
+	writeTestFiles(t, sourceDir, map[string]string{
+		"backends.tpl": `{{ define "backend" }}server {{ .Name }}{{ "\n" }}{{ end }}`,
+	})
+	touchTestFile(t, filepath.Join(sourceDir, "backends.tpl"))
+
+	assertConfig("domain cluster.local\nserver a\nserver b\n")
+	assert.False(t, parsed == tpl.cache.parsed, "template should be parsed again if some file changes")
+}
+
+// touchTestFile ensures that the modification time of a file changes
+func touchTestFile(t *testing.T, path string) {
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateKeepsLastValidVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "config.tpl")
+	configPath := filepath.Join(dir, "config")
+	writeTestFiles(t, dir, map[string]string{"config.tpl": "domain {{ .Domain }}"})
+	tpl := &templateFile{Source: source, Path: configPath}
+	info := &ClusterInformation{Domain: "cluster.local"}
+
+	if err := tpl.Execute(info); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFiles(t, dir, map[string]string{"config.tpl": "domain {{ .Domain "})
+	touchTestFile(t, source)
+	_, changed, err := tpl.load()
+	assert.NoError(t, err, "last valid version should be used")
+	assert.False(t, changed)
+
+	info.Domain = "example.com"
+	assert.NoError(t, tpl.Execute(info))
+	config, _ := ioutil.ReadFile(configPath)
+	assert.Equal(t, "domain example.com", string(config))
+
+	// Configuration is not written if execution fails
+	writeTestFiles(t, dir, map[string]string{"config.tpl": "domain {{ .Unknown }}"})
+	touchTestFile(t, source)
+	assert.Error(t, tpl.Execute(info))
+	config, _ = ioutil.ReadFile(configPath)
+	assert.Equal(t, "domain example.com", string(config))
+
+	// Without a valid version, errors are returned
+	invalid := &templateFile{Source: filepath.Join(dir, "notexists.tpl"), Path: configPath}
+	_, _, err = invalid.load()
+	assert.Error(t, err)
+}
+
+func TestTemplateFingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube2lb-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "config.tpl")
+	writeTestFiles(t, dir, map[string]string{"config.tpl": "domain {{ .Domain }}"})
+	info, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := templateFingerprint([]string{source})
+	assert.NoError(t, err)
+
+	// Same size and modification time, only content changes
+	writeTestFiles(t, dir, map[string]string{"config.tpl": "domain {{ .Dom4in }}"})
+	if err := os.Chtimes(source, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	after, err := templateFingerprint([]string{source})
+	assert.NoError(t, err)
+	assert.NotEqual(t, before, after)
+
+	_, err = templateFingerprint([]string{filepath.Join(dir, "notexists.tpl")})
+	assert.Error(t, err)
+}
+
+func TestTemplateWatch(t *testing.T) {
+	oldTemplateCheckInterval := templateCheckInterval
+	templateCheckInterval = 10 * time.Millisecond
+	defer func() { templateCheckInterval = oldTemplateCheckInterval }()
+
+	dir, err := ioutil.TempDir("", "kube2lb-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "config.tpl")
+	writeTestFiles(t, dir, map[string]string{"config.tpl": "domain {{ .Domain }}"})
+	tpl := &templateFile{Source: source, Path: filepath.Join(dir, "config")}
+	if err := tpl.Execute(&ClusterInformation{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notified := make(chan struct{}, 10)
+	go tpl.Watch(ctx, func() { notified <- struct{}{} })
+
+	assertNotified := func(expected bool, message string) {
+		select {
+		case <-notified:
+			assert.True(t, expected, message)
+		case <-time.After(100 * time.Millisecond):
+			assert.False(t, expected, message)
+		}
+	}
+
+	assertNotified(false, "no changes")
+
+	writeTestFiles(t, dir, map[string]string{"config.tpl": "domain {{ .Domain"})
+	touchTestFile(t, source)
+	assertNotified(false, "invalid template")
+
+	writeTestFiles(t, dir, map[string]string{"config.tpl": "domain: {{ .Domain }}"})
+	future := time.Now().Add(2 * time.Minute)
+	os.Chtimes(source, future, future)
+	assertNotified(true, "valid change")
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Maximum weight of an endpoint, as supported by most load balancers
+const maxEndpointWeight = 256
+
+// TrafficSplit is the content of the traffic split annotation
+type TrafficSplit struct {
+	Group  string `json:"group"`
+	Weight int    `json:"weight"`
+}
+
+func (t *TrafficSplit) Validate() error {
+	if errs := validation.IsDNS1123Label(t.Group); len(errs) > 0 {
+		return fmt.Errorf("invalid group %q: %s", t.Group, strings.Join(errs, ", "))
+	}
+	if t.Weight < 0 {
+		return fmt.Errorf("weight must be positive, found %d", t.Weight)
+	}
+	return nil
+}
+
+// TrafficSplitInformation describes a group of services merged in a single
+// logical service
+type TrafficSplitInformation struct {
+	Group    string
+	Services []TrafficSplitService
+}
+
+type TrafficSplitService struct {
+	Name      string
+	Weight    int
+	Endpoints int
+}
+
+func trafficSplitKey(s ServiceInformation) string {
+	return fmt.Sprintf("%s %s %s %s", s.Namespace, s.TrafficSplit.Group, s.Port, s.PortName)
+}
+
+// mergeTrafficSplits merges the ports of services in the same traffic split
+// group into a single service named as the group. Settings of the merged
+// service are taken from the service with the same name as the group if it
+// is a member, or from the first one in name order. Weights of services are
+// distributed between their endpoints.
+func mergeTrafficSplits(services []ServiceInformation) []ServiceInformation {
+	groups := make(map[string][]ServiceInformation)
+	merged := make([]ServiceInformation, 0, len(services))
+	for _, service := range services {
+		if service.TrafficSplit == nil {
+			merged = append(merged, service)
+			continue
+		}
+		key := trafficSplitKey(service)
+		if _, found := groups[key]; !found {
+			// Keep a placeholder to preserve the order of services
+			merged = append(merged, service)
+		}
+		groups[key] = append(groups[key], service)
+	}
+
+	for i, service := range merged {
+		if service.TrafficSplit == nil {
+			continue
+		}
+		merged[i] = mergeTrafficSplitGroup(groups[trafficSplitKey(service)])
+	}
+	return merged
+}
+
+func mergeTrafficSplitGroup(members []ServiceInformation) ServiceInformation {
+	group := members[0].TrafficSplit.Group
+	sort.SliceStable(members, func(i, j int) bool {
+		if (members[i].Name == group) != (members[j].Name == group) {
+			return members[i].Name == group
+		}
+		return members[i].Name < members[j].Name
+	})
+
+	var maxShare float64
+	for _, member := range members {
+		if len(member.Endpoints) == 0 {
+			continue
+		}
+		share := float64(member.TrafficSplit.Services[0].Weight) / float64(len(member.Endpoints))
+		maxShare = math.Max(maxShare, share)
+	}
+
+	service := members[0]
+	service.Name = group
+	service.External = nil
+	service.Endpoints = nil
+	service.TrafficSplit = &TrafficSplitInformation{Group: group}
+
+	seen := make(map[string]bool)
+	for _, member := range members {
+		for _, external := range member.External {
+			if !seen[external] {
+				seen[external] = true
+				service.External = append(service.External, external)
+			}
+		}
+
+		weight := member.TrafficSplit.Services[0].Weight
+		endpointWeight := 0
+		if weight > 0 && maxShare > 0 {
+			share := float64(weight) / float64(len(member.Endpoints))
+			endpointWeight = int(math.Max(1, math.Floor(share/maxShare*maxEndpointWeight+0.5)))
+		}
+		for _, endpoint := range member.Endpoints {
+			endpoint.Weight = endpointWeight
+			service.Endpoints = append(service.Endpoints, endpoint)
+		}
+
+		service.TrafficSplit.Services = append(service.TrafficSplit.Services, TrafficSplitService{
+			Name:      member.Name,
+			Weight:    weight,
+			Endpoints: len(member.Endpoints),
+		})
+	}
+	return service
+}
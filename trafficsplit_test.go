@@ -0,0 +1,106 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func splitService(name, group string, weight int, external []string, endpoints ...string) ServiceInformation {
+	s := ServiceInformation{
+		Name:      name,
+		Namespace: "default",
+		PortName:  "http",
+		Port:      PortSpec{Port: 80, Mode: "http", Protocol: "tcp"},
+		External:  external,
+	}
+	for _, endpoint := range endpoints {
+		s.Endpoints = append(s.Endpoints, ServiceEndpoint{Name: endpoint, IP: "10.0.0.1", Port: 8080})
+	}
+	if group != "" {
+		s.TrafficSplit = &TrafficSplitInformation{
+			Group:    group,
+			Services: []TrafficSplitService{{Name: name, Weight: weight}},
+		}
+	}
+	return s
+}
+
+func TestMergeTrafficSplits(t *testing.T) {
+	services := []ServiceInformation{
+		splitService("shop-canary", "shop", 10, []string{"shop.example.com", "canary.example.com"}, "canary-1"),
+		splitService("other", "", 0, nil, "other-1"),
+		splitService("shop", "shop", 90, []string{"shop.example.com"}, "shop-1", "shop-2", "shop-3"),
+		splitService("drained", "shop", 0, nil, "drained-1"),
+	}
+
+	merged := mergeTrafficSplits(services)
+	if !assert.Len(t, merged, 2) {
+		return
+	}
+
+	shop := merged[0]
+	assert.Equal(t, "shop", shop.Name)
+	assert.Equal(t, []string{"shop.example.com", "canary.example.com"}, shop.External)
+	assert.Equal(t, &TrafficSplitInformation{
+		Group: "shop",
+		Services: []TrafficSplitService{
+			{Name: "shop", Weight: 90, Endpoints: 3},
+			{Name: "drained", Weight: 0, Endpoints: 1},
+			{Name: "shop-canary", Weight: 10, Endpoints: 1},
+		},
+	}, shop.TrafficSplit)
+
+	weights := make(map[string]int)
+	for _, endpoint := range shop.Endpoints {
+		weights[endpoint.Name] = endpoint.Weight
+	}
+	assert.Equal(t, map[string]int{
+		"shop-1":    256,
+		"shop-2":    256,
+		"shop-3":    256,
+		"drained-1": 0,
+		"canary-1":  85,
+	}, weights)
+
+	assert.Equal(t, "other", merged[1].Name)
+	assert.Nil(t, merged[1].TrafficSplit)
+	assert.Equal(t, 0, merged[1].Endpoints[0].Weight)
+}
+
+func TestMergeTrafficSplitsDifferentNamespaces(t *testing.T) {
+	a := splitService("a", "group", 1, nil, "a-1")
+	b := splitService("b", "group", 1, nil, "b-1")
+	b.Namespace = "other"
+
+	merged := mergeTrafficSplits([]ServiceInformation{a, b})
+	assert.Len(t, merged, 2)
+	for _, service := range merged {
+		assert.Equal(t, "group", service.Name)
+		assert.Len(t, service.Endpoints, 1)
+	}
+}
+
+func TestTrafficSplitValidate(t *testing.T) {
+	assert.NoError(t, (&TrafficSplit{Group: "shop", Weight: 10}).Validate())
+	assert.NoError(t, (&TrafficSplit{Group: "shop", Weight: 0}).Validate())
+	assert.Error(t, (&TrafficSplit{Group: "", Weight: 10}).Validate())
+	assert.Error(t, (&TrafficSplit{Group: "Shop.example", Weight: 10}).Validate())
+	assert.Error(t, (&TrafficSplit{Group: "shop", Weight: -1}).Validate())
+}
@@ -0,0 +1,642 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// Envoy xDS v3 is served with the aggregated discovery service (ADS) over
+// gRPC, envoy opens a stream to request all types of resources and changes
+// are pushed through it. Each resource has its own version, so when
+// endpoints of a service change, only its endpoints are sent again.
+
+var xdsServerAddress string
+
+func init() {
+	flag.StringVar(&xdsServerAddress, "xds-address", "", "Address where the envoy xDS aggregated discovery service is served with gRPC, disabled if empty")
+}
+
+const xdsADSMethod = "/envoy.service.discovery.v3.AggregatedDiscoveryService/StreamAggregatedResources"
+
+// Types of resources in the order they are sent, clusters before their
+// endpoints and listeners before their routes, so envoy doesn't receive
+// references to resources it doesn't have yet
+var xdsTypes = []string{XDSClusterType, XDSEndpointType, XDSListenerType, XDSRouteType}
+
+// xdsFullState returns true for the types whose responses contain all the
+// resources of the type, for other types only requested resources are sent,
+// and only if they change
+func xdsFullState(typeURL string) bool {
+	return typeURL == XDSListenerType || typeURL == XDSClusterType
+}
+
+// xdsResource is a resource served to envoy
+type xdsResource interface {
+	proto.Message
+	resourceName() string
+}
+
+func (c *xdsCluster) resourceName() string               { return c.Name }
+func (a *xdsClusterLoadAssignment) resourceName() string { return a.ClusterName }
+func (l *xdsListener) resourceName() string              { return l.Name }
+func (r *xdsRouteConfiguration) resourceName() string    { return r.Name }
+
+// Envoy load balancing policies used for the balancing algorithms that have
+// an equivalent
+var xdsLBPolicies = map[string]int32{
+	"roundrobin": xdsLBRoundRobin,
+	"leastconn":  xdsLBLeastRequest,
+	"source":     xdsLBRingHash,
+	"random":     xdsLBRandom,
+}
+
+const defaultXDSLBPolicy = xdsLBLeastRequest
+
+// xdsSupported returns true if a service can be served by envoy, envoy only
+// supports TCP
+func xdsSupported(s ServiceInformation) bool {
+	return s.Port.Protocol == "tcp"
+}
+
+func xdsClusterFor(s ServiceInformation) *xdsCluster {
+	cluster := &xdsCluster{
+		Name:           s.String(),
+		ConnectTimeout: xdsDurationOf(5 * time.Second),
+		LBPolicy:       defaultXDSLBPolicy,
+	}
+	if policy, ok := xdsLBPolicies[s.Balance]; ok {
+		cluster.LBPolicy = policy
+	}
+
+	if s.Resolution == ExternalNameResolutionDNS {
+		// EDS only supports IPs, names are resolved by envoy
+		cluster.Type = xdsClusterStrictDNS
+		var endpoints []*xdsLBEndpoint
+		for _, e := range s.Endpoints {
+			host := e.Hostname
+			if host == "" {
+				host = e.IP
+			}
+			endpoints = append(endpoints, &xdsLBEndpoint{Endpoint: &xdsEndpoint{xdsSocketAddressOf(host, e.Port)}})
+		}
+		cluster.LoadAssignment = &xdsClusterLoadAssignment{
+			ClusterName: s.String(),
+			Endpoints:   []*xdsLocalityLBEndpoints{{LBEndpoints: endpoints}},
+		}
+	} else {
+		cluster.Type = xdsClusterEDS
+		cluster.EDSClusterConfig = &xdsEDSClusterConfig{xdsADSConfigSource()}
+	}
+
+	if h := s.HealthCheck; h != nil {
+		check := &xdsHealthCheck{
+			Timeout:            xdsDurationOf(3 * time.Second),
+			Interval:           xdsDurationOf(5 * time.Second),
+			UnhealthyThreshold: &xdsUInt32Value{3},
+			HealthyThreshold:   &xdsUInt32Value{1},
+		}
+		if h.Interval > 0 {
+			check.Interval = xdsMilliseconds(h.Interval)
+		}
+		if h.Path != "" && s.Port.Mode == "http" {
+			check.HTTPHealthCheck = &xdsHTTPHealthCheck{h.Path}
+		} else {
+			check.TCPHealthCheck = &xdsTCPHealthCheck{}
+		}
+		cluster.HealthChecks = []*xdsHealthCheck{check}
+	}
+
+	if s.MaxConnections > 0 && len(s.Endpoints) > 0 {
+		// Envoy limits connections per cluster
+		cluster.CircuitBreakers = &xdsCircuitBreakers{[]*xdsThresholds{
+			{MaxConnections: &xdsUInt32Value{uint32(s.MaxConnections * len(s.Endpoints))}},
+		}}
+	}
+	return cluster
+}
+
+func xdsLoadAssignmentFor(s ServiceInformation) *xdsClusterLoadAssignment {
+	var endpoints []*xdsLBEndpoint
+	for _, e := range s.Endpoints {
+		if net.ParseIP(e.IP) == nil {
+			continue
+		}
+		endpoint := &xdsLBEndpoint{Endpoint: &xdsEndpoint{xdsSocketAddressOf(e.IP, e.Port)}}
+		if s.TrafficSplit != nil {
+			if e.Weight == 0 {
+				continue
+			}
+			endpoint.LoadBalancingWeight = &xdsUInt32Value{uint32(e.Weight)}
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return &xdsClusterLoadAssignment{
+		ClusterName: s.String(),
+		Endpoints:   []*xdsLocalityLBEndpoints{{LBEndpoints: endpoints}},
+	}
+}
+
+// xdsPathRegex converts a path regular expression, that can match any part
+// of the path, to a regular expression that matches the whole path, as
+// expected by envoy
+func xdsPathRegex(r string) string {
+	if !strings.HasPrefix(r, "^") {
+		r = ".*" + r
+	}
+	r = strings.TrimPrefix(r, "^")
+	if !strings.HasSuffix(r, "$") {
+		r = r + ".*"
+	}
+	return strings.TrimSuffix(r, "$")
+}
+
+// xdsStripPrefix returns the rewrite that removes a prefix from the path,
+// with the slash that can follow it, so nested paths keep a single slash
+func xdsStripPrefix(prefix string) *xdsRegexMatchAndSubstitute {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return &xdsRegexMatchAndSubstitute{
+		Pattern:      &xdsRegexMatcher{Regex: "^" + regexp.QuoteMeta(prefix) + "/?(.*)$"},
+		Substitution: "/\\1",
+	}
+}
+
+func xdsRouteFor(r PathRoute) *xdsRoute {
+	route := &xdsRoute{
+		Match: &xdsRouteMatch{},
+		Route: &xdsRouteAction{Cluster: r.Service.String()},
+	}
+	if r.Service.Timeout > 0 {
+		route.Route.Timeout = xdsMilliseconds(r.Service.Timeout)
+	}
+	switch {
+	case r.Path == nil:
+		route.Match.Prefix = "/"
+	case r.Path.IsRegexp():
+		route.Match.SafeRegex = &xdsRegexMatcher{Regex: xdsPathRegex(r.Path.Regexp())}
+	default:
+		route.Match.Prefix = r.Path.Path
+		if r.Path.StripPrefix {
+			route.Route.RegexRewrite = xdsStripPrefix(r.Path.Path)
+		}
+	}
+	return route
+}
+
+// xdsRouteConfigurationFor returns the routes for an HTTP port, with a
+// virtual host for each server name, as envoy doesn't allow to repeat
+// domains. Regular expressions are not supported as server names.
+func xdsRouteConfigurationFor(services []ServiceInformation, port PortSpec, domain string) *xdsRouteConfiguration {
+	config := &xdsRouteConfiguration{Name: port.String()}
+	hosts := make(map[serverName]*xdsVirtualHost)
+	for _, r := range pathRoutes(services) {
+		if r.Service.Port.String() != port.String() {
+			continue
+		}
+		for _, name := range generateServerNames(r.Service, domain) {
+			if name.IsRegexp() {
+				continue
+			}
+			host, found := hosts[name]
+			if !found {
+				host = &xdsVirtualHost{
+					Name:    nginxName(name),
+					Domains: []string{string(name)},
+				}
+				hosts[name] = host
+				config.VirtualHosts = append(config.VirtualHosts, host)
+			}
+			host.Routes = append(host.Routes, xdsRouteFor(r))
+		}
+	}
+	return config
+}
+
+// xdsTLSTransportSocket returns the transport socket that terminates TLS
+// with a certificate file, that contains the certificate and its key
+func xdsTLSTransportSocket(certFile string) (*xdsTransportSocket, error) {
+	dataSource := &xdsDataSource{Filename: certFile}
+	context, err := xdsMarshalAny(xdsDownstreamTLSContextType, &xdsDownstreamTLSContext{
+		CommonTLSContext: &xdsCommonTLSContext{
+			TLSCertificates: []*xdsTLSCertificate{{
+				CertificateChain: dataSource,
+				PrivateKey:       dataSource,
+			}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &xdsTransportSocket{Name: "envoy.transport_sockets.tls", TypedConfig: context}, nil
+}
+
+func xdsHTTPConnectionManagerFilter(port PortSpec) (*xdsFilter, error) {
+	router, err := xdsMarshalAny(xdsRouterType, &xdsRouter{})
+	if err != nil {
+		return nil, err
+	}
+	manager, err := xdsMarshalAny(xdsHTTPConnectionManagerType, &xdsHTTPConnectionManager{
+		StatPrefix: port.String(),
+		RDS: &xdsRDS{
+			ConfigSource:    xdsADSConfigSource(),
+			RouteConfigName: port.String(),
+		},
+		HTTPFilters: []*xdsHTTPFilter{{Name: "envoy.filters.http.router", TypedConfig: router}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &xdsFilter{Name: "envoy.filters.network.http_connection_manager", TypedConfig: manager}, nil
+}
+
+func xdsListenersFor(services []ServiceInformation, port PortSpec) ([]*xdsListener, error) {
+	var chains []*xdsFilterChain
+	if port.Mode == "http" {
+		filter, err := xdsHTTPConnectionManagerFilter(port)
+		if err != nil {
+			return nil, err
+		}
+		// A filter chain for each certificate, selected by SNI
+		seen := make(map[string]bool)
+		for _, s := range services {
+			if s.Port.String() != port.String() || s.TLS == nil || s.TLS.CertFile == "" || seen[s.TLS.CertFile] {
+				continue
+			}
+			seen[s.TLS.CertFile] = true
+			socket, err := xdsTLSTransportSocket(s.TLS.CertFile)
+			if err != nil {
+				return nil, err
+			}
+			chains = append(chains, &xdsFilterChain{
+				FilterChainMatch: &xdsFilterChainMatch{ServerNames: s.TLS.SNI},
+				Filters:          []*xdsFilter{filter},
+				TransportSocket:  socket,
+			})
+		}
+		if len(chains) == 0 {
+			chains = []*xdsFilterChain{{Filters: []*xdsFilter{filter}}}
+		}
+	} else {
+		for _, s := range services {
+			if s.Port.String() != port.String() {
+				continue
+			}
+			proxy, err := xdsMarshalAny(xdsTCPProxyType, &xdsTCPProxy{
+				StatPrefix: s.String(),
+				Cluster:    s.String(),
+			})
+			if err != nil {
+				return nil, err
+			}
+			chains = append(chains, &xdsFilterChain{
+				Filters: []*xdsFilter{{Name: "envoy.filters.network.tcp_proxy", TypedConfig: proxy}},
+			})
+			// Only one service can use a port in tcp mode
+			break
+		}
+	}
+
+	var listeners []*xdsListener
+	for _, ip := range port.IPs {
+		// Listeners are named as the port with the IP they listen on
+		name := PortSpec{IP: ip, Port: port.Port, Mode: port.Mode, Protocol: port.Protocol}.String()
+		listeners = append(listeners, &xdsListener{
+			Name:         name,
+			Address:      xdsSocketAddressOf(ip.String(), port.Port),
+			FilterChains: chains,
+		})
+	}
+	return listeners, nil
+}
+
+// xdsVersionedResource is a resource encoded to be sent to envoy, with a
+// version that only changes if the resource changes
+type xdsVersionedResource struct {
+	name    string
+	version string
+	encoded *xdsAny
+}
+
+// xdsSnapshot contains the resources of a type, with a version that changes
+// if any of them changes
+type xdsSnapshot struct {
+	version   string
+	resources []xdsVersionedResource
+}
+
+func newXDSSnapshot(typeURL string, resources []xdsResource) (*xdsSnapshot, error) {
+	snapshot := &xdsSnapshot{}
+	versions := sha256.New()
+	for _, r := range resources {
+		encoded, err := xdsMarshalAny(typeURL, r)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(encoded.Value)
+		version := hex.EncodeToString(sum[:8])
+		fmt.Fprintf(versions, "%s %s\n", r.resourceName(), version)
+		snapshot.resources = append(snapshot.resources, xdsVersionedResource{
+			name:    r.resourceName(),
+			version: version,
+			encoded: encoded,
+		})
+	}
+	snapshot.version = hex.EncodeToString(versions.Sum(nil)[:8])
+	return snapshot, nil
+}
+
+// XDSServer serves the cluster information as envoy resources, it can be
+// used as a Template, so resources are updated on each change
+type XDSServer struct {
+	sync.RWMutex
+	snapshots map[string]*xdsSnapshot
+
+	// Closed and replaced when resources change, to wake up streams
+	updated chan struct{}
+}
+
+func NewXDSServer() *XDSServer {
+	return &XDSServer{
+		snapshots: make(map[string]*xdsSnapshot),
+		updated:   make(chan struct{}),
+	}
+}
+
+// Execute builds the resources for the cluster information, streams are only
+// notified if any resource changes
+func (x *XDSServer) Execute(info *ClusterInformation) error {
+	var services []ServiceInformation
+	for _, s := range info.Services {
+		if xdsSupported(s) {
+			services = append(services, s)
+		}
+	}
+
+	resources := make(map[string][]xdsResource)
+	for _, s := range services {
+		resources[XDSClusterType] = append(resources[XDSClusterType], xdsClusterFor(s))
+		if s.Resolution != ExternalNameResolutionDNS {
+			resources[XDSEndpointType] = append(resources[XDSEndpointType], xdsLoadAssignmentFor(s))
+		}
+	}
+	for _, port := range info.Ports {
+		if port.Protocol != "tcp" {
+			continue
+		}
+		listeners, err := xdsListenersFor(services, port)
+		if err != nil {
+			return fmt.Errorf("couldn't build xDS listeners: %s", err)
+		}
+		for _, l := range listeners {
+			resources[XDSListenerType] = append(resources[XDSListenerType], l)
+		}
+		if port.Mode == "http" {
+			resources[XDSRouteType] = append(resources[XDSRouteType], xdsRouteConfigurationFor(services, port, info.Domain))
+		}
+	}
+
+	snapshots := make(map[string]*xdsSnapshot)
+	for _, t := range xdsTypes {
+		snapshot, err := newXDSSnapshot(t, resources[t])
+		if err != nil {
+			return fmt.Errorf("couldn't build xDS resources: %s", err)
+		}
+		snapshots[t] = snapshot
+	}
+
+	x.Lock()
+	defer x.Unlock()
+	changed := false
+	for _, t := range xdsTypes {
+		snapshot := snapshots[t]
+		if current, found := x.snapshots[t]; !found || current.version != snapshot.version {
+			log.Printf("Updating xDS resources of type %s to version %s", t, snapshot.version)
+			x.snapshots[t] = snapshot
+			changed = true
+		}
+	}
+	if changed {
+		close(x.updated)
+		x.updated = make(chan struct{})
+	}
+	return nil
+}
+
+// snapshot returns the current resources of a type, nil if they are not
+// available yet
+func (x *XDSServer) snapshot(typeURL string) *xdsSnapshot {
+	x.RLock()
+	defer x.RUnlock()
+	return x.snapshots[typeURL]
+}
+
+// watch returns a channel closed on next change of resources
+func (x *XDSServer) watch() <-chan struct{} {
+	x.RLock()
+	defer x.RUnlock()
+	return x.updated
+}
+
+// xdsWatch is the state of a type of resource in a stream
+type xdsWatch struct {
+	// Names of the requested resources
+	names []string
+
+	// Version and nonce of last response, and versions of the resources
+	// sent by name
+	version string
+	nonce   string
+	sent    map[string]string
+}
+
+// xdsStream is the state of an aggregated discovery stream with envoy
+type xdsStream struct {
+	server  *XDSServer
+	stream  *grpcStream
+	node    string
+	nonce   uint64
+	watches map[string]*xdsWatch
+}
+
+func (x *XDSServer) streamAggregatedResources(stream *grpcStream) error {
+	requests := make(chan *xdsDiscoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			request := &xdsDiscoveryRequest{}
+			if err := stream.Recv(request); err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case requests <- request:
+			case <-stream.Done():
+				return
+			}
+		}
+	}()
+
+	s := &xdsStream{server: x, stream: stream, watches: make(map[string]*xdsWatch)}
+	for {
+		updated := x.watch()
+		select {
+		case <-stream.Done():
+			return nil
+		case err := <-errs:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case request := <-requests:
+			if err := s.request(request); err != nil {
+				return err
+			}
+		case <-updated:
+			for _, t := range xdsTypes {
+				if w, found := s.watches[t]; found {
+					if err := s.send(t, w, false); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
+
+// request handles a discovery request, resources are sent if they weren't
+// sent before, or if they are requested again
+func (s *xdsStream) request(r *xdsDiscoveryRequest) error {
+	if r.Node != nil && r.Node.ID != "" {
+		s.node = r.Node.ID
+	}
+
+	known := false
+	for _, t := range xdsTypes {
+		known = known || t == r.TypeURL
+	}
+	if !known {
+		log.Printf("Ignoring request of unknown xDS type %s from %s", r.TypeURL, s.node)
+		return nil
+	}
+
+	w, found := s.watches[r.TypeURL]
+	if !found {
+		w = &xdsWatch{sent: make(map[string]string)}
+		s.watches[r.TypeURL] = w
+	}
+	if r.ResponseNonce != w.nonce {
+		// Stale request, a newer response has been already sent
+		return nil
+	}
+	if r.ErrorDetail != nil {
+		// Resources are sent again when they change
+		log.Printf("Envoy %s rejected xDS resources of type %s with version %s: %s", s.node, r.TypeURL, w.version, r.ErrorDetail.Message)
+		return nil
+	}
+
+	names := r.ResourceNames
+	if xdsFullState(r.TypeURL) {
+		names = nil
+	}
+	force := r.VersionInfo != w.version || !reflect.DeepEqual(names, w.names)
+	w.names = names
+	return s.send(r.TypeURL, w, force)
+}
+
+// send sends the resources of a type that changed since last response, or
+// all of them if forced
+func (s *xdsStream) send(typeURL string, w *xdsWatch, force bool) error {
+	snapshot := s.server.snapshot(typeURL)
+	if snapshot == nil {
+		// Sent on first update
+		return nil
+	}
+	if !force && snapshot.version == w.version {
+		return nil
+	}
+
+	requested := make(map[string]bool)
+	for _, name := range w.names {
+		requested[name] = true
+	}
+
+	var resources []xdsVersionedResource
+	for _, r := range snapshot.resources {
+		switch {
+		case xdsFullState(typeURL):
+		case !requested[r.name]:
+			continue
+		case !force && w.sent[r.name] == r.version:
+			continue
+		}
+		resources = append(resources, r)
+	}
+	if len(resources) == 0 && !xdsFullState(typeURL) {
+		return nil
+	}
+
+	s.nonce++
+	response := &xdsDiscoveryResponse{
+		VersionInfo: snapshot.version,
+		TypeURL:     typeURL,
+		Nonce:       strconv.FormatUint(s.nonce, 10),
+	}
+	for _, r := range resources {
+		response.Resources = append(response.Resources, r.encoded)
+	}
+	if err := s.stream.Send(response); err != nil {
+		return err
+	}
+
+	w.version, w.nonce = response.VersionInfo, response.Nonce
+	if xdsFullState(typeURL) {
+		w.sent = make(map[string]string)
+	}
+	for _, r := range resources {
+		w.sent[r.name] = r.version
+	}
+	return nil
+}
+
+func (x *XDSServer) grpcServer() grpcServer {
+	return grpcServer{xdsADSMethod: x.streamAggregatedResources}
+}
+
+func (x *XDSServer) Serve(address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("Couldn't serve xDS: %s", err)
+	}
+	log.Printf("Serving xDS in %s", address)
+	if err := x.grpcServer().Serve(listener); err != nil {
+		log.Fatalf("Couldn't serve xDS: %s", err)
+	}
+}
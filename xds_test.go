@@ -0,0 +1,351 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+// testADSClient opens an aggregated discovery stream with an xDS server, as
+// envoy does
+type testADSClient struct {
+	t         *testing.T
+	requests  *io.PipeWriter
+	body      io.ReadCloser
+	responses chan *xdsDiscoveryResponse
+}
+
+func newTestADSClient(t *testing.T, address string) *testADSClient {
+	reader, writer := io.Pipe()
+	request, err := http.NewRequest(http.MethodPost, "http://"+address+xdsADSMethod, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	resp, err := newTestH2CTransport().RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testADSClient{
+		t:         t,
+		requests:  writer,
+		body:      resp.Body,
+		responses: make(chan *xdsDiscoveryResponse, 10),
+	}
+	go func() {
+		defer close(c.responses)
+		for {
+			response := &xdsDiscoveryResponse{}
+			if err := readGRPCMessage(resp.Body, response); err != nil {
+				return
+			}
+			c.responses <- response
+		}
+	}()
+	return c
+}
+
+func (c *testADSClient) Close() {
+	c.requests.Close()
+	c.body.Close()
+}
+
+func (c *testADSClient) request(request *xdsDiscoveryRequest) {
+	if err := writeGRPCMessage(c.requests, request); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// ack acknowledges a response, requesting the same names again
+func (c *testADSClient) ack(response *xdsDiscoveryResponse, names ...string) {
+	c.request(&xdsDiscoveryRequest{
+		VersionInfo:   response.VersionInfo,
+		TypeURL:       response.TypeURL,
+		ResponseNonce: response.Nonce,
+		ResourceNames: names,
+	})
+}
+
+func (c *testADSClient) receive() *xdsDiscoveryResponse {
+	select {
+	case response, ok := <-c.responses:
+		if !ok {
+			c.t.Fatal("stream closed")
+		}
+		return response
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timeout waiting for response")
+	}
+	return nil
+}
+
+func (c *testADSClient) assertNoResponse(message string) {
+	select {
+	case response := <-c.responses:
+		assert.Fail(c.t, "unexpected response of type "+response.TypeURL, message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func decodeTestResources(t *testing.T, response *xdsDiscoveryResponse, newResource func() xdsResource) ([]xdsResource, []string) {
+	var resources []xdsResource
+	var names []string
+	for _, encoded := range response.Resources {
+		assert.Equal(t, response.TypeURL, encoded.TypeURL)
+		r := newResource()
+		if err := proto.Unmarshal(encoded.Value, r); err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, r)
+		names = append(names, r.resourceName())
+	}
+	return resources, names
+}
+
+func testXDSClusterInformation(webEndpoints []ServiceEndpoint) *ClusterInformation {
+	http := PortSpec{IP: net.IPv4zero, IPs: []net.IP{net.IPv4zero, net.IPv6zero}, Port: 80, Mode: "http", Protocol: "tcp"}
+	tcp := PortSpec{IP: net.IPv4zero, IPs: []net.IP{net.IPv4zero}, Port: 3306, Mode: "tcp", Protocol: "tcp"}
+	udp := PortSpec{IP: net.IPv4zero, IPs: []net.IP{net.IPv4zero}, Port: 53, Protocol: "udp"}
+	return &ClusterInformation{
+		Services: []ServiceInformation{
+			{
+				Name:        "web",
+				Namespace:   "test",
+				Port:        http,
+				Endpoints:   webEndpoints,
+				External:    []string{"www.example.com", "~^web[0-9]+$"},
+				HealthCheck: &HealthCheck{Path: "/healthz", Interval: 2000},
+			},
+			{
+				Name:      "api",
+				Namespace: "test",
+				Port:      http,
+				Endpoints: []ServiceEndpoint{{Name: "api-1", IP: "10.1.0.3", Port: 8080}},
+				External:  []string{"www.example.com"},
+				Paths:     []PathRule{{Path: "/api", StripPrefix: true}, {Path: "~^/v[0-9]+/"}},
+				Timeout:   30000,
+			},
+			{
+				Name:      "mysql",
+				Namespace: "test",
+				Port:      tcp,
+				Endpoints: []ServiceEndpoint{{Name: "mysql-1", IP: "10.1.0.4", Port: 3306}},
+				Balance:   "roundrobin",
+			},
+			{
+				Name:       "db",
+				Namespace:  "test",
+				Port:       PortSpec{IP: net.IPv4zero, IPs: []net.IP{net.IPv4zero}, Port: 5432, Mode: "tcp", Protocol: "tcp"},
+				Endpoints:  []ServiceEndpoint{{Name: "db.example.com", Hostname: "db.example.com", Port: 5432}},
+				Resolution: ExternalNameResolutionDNS,
+			},
+			{
+				Name:      "dns",
+				Namespace: "kube-system",
+				Port:      udp,
+				Endpoints: []ServiceEndpoint{{Name: "dns-1", IP: "10.1.0.5", Port: 53}},
+			},
+		},
+		Ports:  []PortSpec{http, tcp, udp},
+		Domain: "cluster.local",
+	}
+}
+
+func TestXDSServer(t *testing.T) {
+	if err := initServerNameTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	xds := NewXDSServer()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go xds.grpcServer().Serve(listener)
+
+	client := newTestADSClient(t, listener.Addr().String())
+	defer client.Close()
+
+	client.request(&xdsDiscoveryRequest{Node: &xdsNode{ID: "test"}, TypeURL: XDSClusterType})
+	client.assertNoResponse("no resources before first update")
+
+	webEndpoints := []ServiceEndpoint{{Name: "web-1", IP: "10.1.0.1", Port: 8080}}
+	if err := xds.Execute(testXDSClusterInformation(webEndpoints)); err != nil {
+		t.Fatal(err)
+	}
+
+	clusters := client.receive()
+	assert.Equal(t, XDSClusterType, clusters.TypeURL)
+	resources, names := decodeTestResources(t, clusters, func() xdsResource { return &xdsCluster{} })
+	assert.Equal(t, []string{"web_test_80_tcp_http", "api_test_80_tcp_http", "mysql_test_3306_tcp_tcp", "db_test_5432_tcp_tcp"}, names)
+	if assert.Len(t, resources, 4) {
+		web := resources[0].(*xdsCluster)
+		assert.Equal(t, int32(xdsClusterEDS), web.Type)
+		assert.Equal(t, int32(xdsLBLeastRequest), web.LBPolicy)
+		if assert.NotNil(t, web.EDSClusterConfig) {
+			assert.NotNil(t, web.EDSClusterConfig.EDSConfig.ADS, "endpoints are requested in the same stream")
+		}
+		if assert.Len(t, web.HealthChecks, 1) {
+			assert.Equal(t, &xdsHTTPHealthCheck{Path: "/healthz"}, web.HealthChecks[0].HTTPHealthCheck)
+			assert.Equal(t, &xdsDuration{Seconds: 2}, web.HealthChecks[0].Interval)
+		}
+		assert.Equal(t, int32(xdsLBRoundRobin), resources[2].(*xdsCluster).LBPolicy)
+		db := resources[3].(*xdsCluster)
+		assert.Equal(t, int32(xdsClusterStrictDNS), db.Type)
+		if assert.NotNil(t, db.LoadAssignment) {
+			address := db.LoadAssignment.Endpoints[0].LBEndpoints[0].Endpoint.Address.SocketAddress
+			assert.Equal(t, &xdsSocketAddress{Address: "db.example.com", PortValue: 5432}, address)
+		}
+	}
+	client.ack(clusters)
+	client.assertNoResponse("clusters shouldn't be sent again if they don't change")
+
+	client.request(&xdsDiscoveryRequest{TypeURL: XDSListenerType})
+	listeners := client.receive()
+	_, names = decodeTestResources(t, listeners, func() xdsResource { return &xdsListener{} })
+	assert.Equal(t, []string{
+		"00000000_80_tcp_http",
+		"00000000000000000000000000000000_80_tcp_http",
+		"00000000_3306_tcp_tcp",
+	}, names)
+	client.ack(listeners)
+
+	routeNames := []string{"00000000_80_tcp_http"}
+	client.request(&xdsDiscoveryRequest{TypeURL: XDSRouteType, ResourceNames: routeNames})
+	routes := client.receive()
+	resources, names = decodeTestResources(t, routes, func() xdsResource { return &xdsRouteConfiguration{} })
+	assert.Equal(t, routeNames, names)
+	if assert.Len(t, resources, 1) {
+		var domains []string
+		for _, host := range resources[0].(*xdsRouteConfiguration).VirtualHosts {
+			domains = append(domains, host.Domains...)
+			if host.Domains[0] == "www.example.com" {
+				assert.Equal(t, []*xdsRoute{
+					{
+						Match: &xdsRouteMatch{Prefix: "/api"},
+						Route: &xdsRouteAction{Cluster: "api_test_80_tcp_http", RegexRewrite: xdsStripPrefix("/api"), Timeout: &xdsDuration{Seconds: 30}},
+					},
+					{
+						Match: &xdsRouteMatch{SafeRegex: &xdsRegexMatcher{Regex: "/v[0-9]+/.*"}},
+						Route: &xdsRouteAction{Cluster: "api_test_80_tcp_http", Timeout: &xdsDuration{Seconds: 30}},
+					},
+					{
+						Match: &xdsRouteMatch{Prefix: "/"},
+						Route: &xdsRouteAction{Cluster: "web_test_80_tcp_http"},
+					},
+				}, host.Routes)
+			}
+		}
+		assert.Equal(t, []string{"api.test.svc.cluster.local", "www.example.com", "web.test.svc.cluster.local"}, domains)
+	}
+	client.ack(routes, routeNames...)
+
+	endpointNames := []string{"web_test_80_tcp_http", "api_test_80_tcp_http", "mysql_test_3306_tcp_tcp"}
+	client.request(&xdsDiscoveryRequest{TypeURL: XDSEndpointType, ResourceNames: endpointNames})
+	endpoints := client.receive()
+	_, names = decodeTestResources(t, endpoints, func() xdsResource { return &xdsClusterLoadAssignment{} })
+	assert.Equal(t, endpointNames, names)
+	client.ack(endpoints, endpointNames...)
+	client.assertNoResponse("acknowledged resources shouldn't be sent again")
+
+	// Changes in endpoints only push the endpoints of the changed service
+	webEndpoints = append(webEndpoints, ServiceEndpoint{Name: "web-2", IP: "10.1.0.2", Port: 8080})
+	if err := xds.Execute(testXDSClusterInformation(webEndpoints)); err != nil {
+		t.Fatal(err)
+	}
+	endpoints = client.receive()
+	assert.Equal(t, XDSEndpointType, endpoints.TypeURL)
+	resources, names = decodeTestResources(t, endpoints, func() xdsResource { return &xdsClusterLoadAssignment{} })
+	assert.Equal(t, []string{"web_test_80_tcp_http"}, names)
+	if assert.Len(t, resources, 1) {
+		assignment := resources[0].(*xdsClusterLoadAssignment)
+		if assert.Len(t, assignment.Endpoints, 1) {
+			assert.Len(t, assignment.Endpoints[0].LBEndpoints, 2)
+		}
+	}
+	client.assertNoResponse("other resources didn't change")
+
+	// Rejected resources are not sent again till they change
+	client.request(&xdsDiscoveryRequest{
+		VersionInfo:   endpoints.VersionInfo,
+		TypeURL:       XDSEndpointType,
+		ResponseNonce: endpoints.Nonce,
+		ResourceNames: endpointNames,
+		ErrorDetail:   &xdsStatus{Code: 3, Message: "invalid endpoints"},
+	})
+	client.assertNoResponse("rejected resources")
+
+	// Identical updates are not pushed
+	if err := xds.Execute(testXDSClusterInformation(webEndpoints)); err != nil {
+		t.Fatal(err)
+	}
+	client.assertNoResponse("nothing changed")
+}
+
+func TestXDSPathRegex(t *testing.T) {
+	cases := []struct {
+		regexp, expected string
+	}{
+		{"^/v1/", "/v1/.*"},
+		{"\\.php$", ".*\\.php"},
+		{"^/exact$", "/exact"},
+		{"admin", ".*admin.*"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, xdsPathRegex(c.regexp))
+	}
+}
+
+func TestXDSStripPrefix(t *testing.T) {
+	cases := []struct {
+		prefix, path, expected string
+	}{
+		{"/api", "/api", "/"},
+		{"/api", "/api/", "/"},
+		{"/api", "/api/users", "/users"},
+		{"/api", "/api/users/1", "/users/1"},
+		{"/api/", "/api/users", "/users"},
+		{"/api/v1", "/api/v1/users", "/users"},
+		{"/", "/users", "/users"},
+	}
+	for _, c := range cases {
+		route := xdsRouteFor(PathRoute{
+			Service: ServiceInformation{Name: "api", Namespace: "test"},
+			Path:    &PathRule{Path: c.prefix, StripPrefix: true},
+		})
+		rewrite := route.Route.RegexRewrite
+		if !assert.NotNil(t, rewrite, c.prefix) {
+			continue
+		}
+		// Envoy uses RE2 as Go, only the syntax of substitutions is different
+		pattern := regexp.MustCompile(rewrite.Pattern.Regex)
+		substitution := strings.Replace(rewrite.Substitution, "\\1", "${1}", -1)
+		assert.Equal(t, c.expected, pattern.ReplaceAllString(c.path, substitution), c.prefix+" "+c.path)
+	}
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2017 Tuenti Technologies S.L. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// Subset of the envoy v3 API messages used by the xDS server, only the fields
+// used by kube2lb are declared, with the field numbers of the envoy protocol
+// buffers definitions. Fields in oneofs are declared as normal fields, as they
+// are encoded in the same way.
+
+const (
+	XDSListenerType = "type.googleapis.com/envoy.config.listener.v3.Listener"
+	XDSClusterType  = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	XDSRouteType    = "type.googleapis.com/envoy.config.route.v3.RouteConfiguration"
+	XDSEndpointType = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+	xdsHTTPConnectionManagerType = "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager"
+	xdsTCPProxyType              = "type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy"
+	xdsRouterType                = "type.googleapis.com/envoy.extensions.filters.http.router.v3.Router"
+	xdsDownstreamTLSContextType  = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext"
+)
+
+// Values of envoy enums
+const (
+	xdsAPIVersionV3 = 2
+
+	xdsClusterStrictDNS = 1
+	xdsClusterEDS       = 3
+
+	xdsLBRoundRobin   = 0
+	xdsLBLeastRequest = 1
+	xdsLBRingHash     = 2
+	xdsLBRandom       = 3
+)
+
+type xdsAny struct {
+	TypeURL string `protobuf:"bytes,1,opt,name=type_url,proto3"`
+	Value   []byte `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+// xdsMarshalAny encodes a message to be embedded in other messages
+func xdsMarshalAny(typeURL string, m proto.Message) (*xdsAny, error) {
+	value, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &xdsAny{TypeURL: typeURL, Value: value}, nil
+}
+
+type xdsDuration struct {
+	Seconds int64 `protobuf:"varint,1,opt,name=seconds,proto3"`
+	Nanos   int32 `protobuf:"varint,2,opt,name=nanos,proto3"`
+}
+
+func xdsDurationOf(d time.Duration) *xdsDuration {
+	return &xdsDuration{
+		Seconds: int64(d / time.Second),
+		Nanos:   int32(d % time.Second),
+	}
+}
+
+func xdsMilliseconds(ms int) *xdsDuration {
+	return xdsDurationOf(time.Duration(ms) * time.Millisecond)
+}
+
+type xdsUInt32Value struct {
+	Value uint32 `protobuf:"varint,1,opt,name=value,proto3"`
+}
+
+type xdsStatus struct {
+	Code    int32  `protobuf:"varint,1,opt,name=code,proto3"`
+	Message string `protobuf:"bytes,2,opt,name=message,proto3"`
+}
+
+type xdsNode struct {
+	ID      string `protobuf:"bytes,1,opt,name=id,proto3"`
+	Cluster string `protobuf:"bytes,2,opt,name=cluster,proto3"`
+}
+
+type xdsDiscoveryRequest struct {
+	VersionInfo   string     `protobuf:"bytes,1,opt,name=version_info,proto3"`
+	Node          *xdsNode   `protobuf:"bytes,2,opt,name=node,proto3"`
+	ResourceNames []string   `protobuf:"bytes,3,rep,name=resource_names,proto3"`
+	TypeURL       string     `protobuf:"bytes,4,opt,name=type_url,proto3"`
+	ResponseNonce string     `protobuf:"bytes,5,opt,name=response_nonce,proto3"`
+	ErrorDetail   *xdsStatus `protobuf:"bytes,6,opt,name=error_detail,proto3"`
+}
+
+func (m *xdsDiscoveryRequest) Reset()         { *m = xdsDiscoveryRequest{} }
+func (m *xdsDiscoveryRequest) String() string { return proto.CompactTextString(m) }
+func (*xdsDiscoveryRequest) ProtoMessage()    {}
+
+type xdsDiscoveryResponse struct {
+	VersionInfo string    `protobuf:"bytes,1,opt,name=version_info,proto3"`
+	Resources   []*xdsAny `protobuf:"bytes,2,rep,name=resources,proto3"`
+	TypeURL     string    `protobuf:"bytes,4,opt,name=type_url,proto3"`
+	Nonce       string    `protobuf:"bytes,5,opt,name=nonce,proto3"`
+}
+
+func (m *xdsDiscoveryResponse) Reset()         { *m = xdsDiscoveryResponse{} }
+func (m *xdsDiscoveryResponse) String() string { return proto.CompactTextString(m) }
+func (*xdsDiscoveryResponse) ProtoMessage()    {}
+
+type xdsSocketAddress struct {
+	Address   string `protobuf:"bytes,2,opt,name=address,proto3"`
+	PortValue uint32 `protobuf:"varint,3,opt,name=port_value,proto3"`
+}
+
+type xdsAddress struct {
+	SocketAddress *xdsSocketAddress `protobuf:"bytes,1,opt,name=socket_address,proto3"`
+}
+
+func xdsSocketAddressOf(address string, port int32) *xdsAddress {
+	return &xdsAddress{&xdsSocketAddress{Address: address, PortValue: uint32(port)}}
+}
+
+type xdsAggregatedConfigSource struct{}
+
+type xdsConfigSource struct {
+	ADS                *xdsAggregatedConfigSource `protobuf:"bytes,3,opt,name=ads,proto3"`
+	ResourceAPIVersion int32                      `protobuf:"varint,6,opt,name=resource_api_version,proto3"`
+}
+
+// xdsADSConfigSource returns the configuration source used by envoy to
+// request resources in the same stream as listeners and clusters
+func xdsADSConfigSource() *xdsConfigSource {
+	return &xdsConfigSource{
+		ADS:                &xdsAggregatedConfigSource{},
+		ResourceAPIVersion: xdsAPIVersionV3,
+	}
+}
+
+type xdsDataSource struct {
+	Filename string `protobuf:"bytes,1,opt,name=filename,proto3"`
+}
+
+type xdsHTTPHealthCheck struct {
+	Path string `protobuf:"bytes,2,opt,name=path,proto3"`
+}
+
+type xdsTCPHealthCheck struct{}
+
+type xdsHealthCheck struct {
+	Timeout            *xdsDuration        `protobuf:"bytes,1,opt,name=timeout,proto3"`
+	Interval           *xdsDuration        `protobuf:"bytes,2,opt,name=interval,proto3"`
+	UnhealthyThreshold *xdsUInt32Value     `protobuf:"bytes,4,opt,name=unhealthy_threshold,proto3"`
+	HealthyThreshold   *xdsUInt32Value     `protobuf:"bytes,5,opt,name=healthy_threshold,proto3"`
+	HTTPHealthCheck    *xdsHTTPHealthCheck `protobuf:"bytes,8,opt,name=http_health_check,proto3"`
+	TCPHealthCheck     *xdsTCPHealthCheck  `protobuf:"bytes,9,opt,name=tcp_health_check,proto3"`
+}
+
+type xdsThresholds struct {
+	MaxConnections *xdsUInt32Value `protobuf:"bytes,2,opt,name=max_connections,proto3"`
+}
+
+type xdsCircuitBreakers struct {
+	Thresholds []*xdsThresholds `protobuf:"bytes,1,rep,name=thresholds,proto3"`
+}
+
+type xdsEDSClusterConfig struct {
+	EDSConfig *xdsConfigSource `protobuf:"bytes,1,opt,name=eds_config,proto3"`
+}
+
+type xdsCluster struct {
+	Name             string                    `protobuf:"bytes,1,opt,name=name,proto3"`
+	Type             int32                     `protobuf:"varint,2,opt,name=type,proto3"`
+	EDSClusterConfig *xdsEDSClusterConfig      `protobuf:"bytes,3,opt,name=eds_cluster_config,proto3"`
+	ConnectTimeout   *xdsDuration              `protobuf:"bytes,4,opt,name=connect_timeout,proto3"`
+	LBPolicy         int32                     `protobuf:"varint,6,opt,name=lb_policy,proto3"`
+	HealthChecks     []*xdsHealthCheck         `protobuf:"bytes,8,rep,name=health_checks,proto3"`
+	CircuitBreakers  *xdsCircuitBreakers       `protobuf:"bytes,10,opt,name=circuit_breakers,proto3"`
+	LoadAssignment   *xdsClusterLoadAssignment `protobuf:"bytes,33,opt,name=load_assignment,proto3"`
+}
+
+func (m *xdsCluster) Reset()         { *m = xdsCluster{} }
+func (m *xdsCluster) String() string { return proto.CompactTextString(m) }
+func (*xdsCluster) ProtoMessage()    {}
+
+type xdsEndpoint struct {
+	Address *xdsAddress `protobuf:"bytes,1,opt,name=address,proto3"`
+}
+
+type xdsLBEndpoint struct {
+	Endpoint            *xdsEndpoint    `protobuf:"bytes,1,opt,name=endpoint,proto3"`
+	LoadBalancingWeight *xdsUInt32Value `protobuf:"bytes,4,opt,name=load_balancing_weight,proto3"`
+}
+
+type xdsLocalityLBEndpoints struct {
+	LBEndpoints []*xdsLBEndpoint `protobuf:"bytes,2,rep,name=lb_endpoints,proto3"`
+}
+
+type xdsClusterLoadAssignment struct {
+	ClusterName string                    `protobuf:"bytes,1,opt,name=cluster_name,proto3"`
+	Endpoints   []*xdsLocalityLBEndpoints `protobuf:"bytes,2,rep,name=endpoints,proto3"`
+}
+
+func (m *xdsClusterLoadAssignment) Reset()         { *m = xdsClusterLoadAssignment{} }
+func (m *xdsClusterLoadAssignment) String() string { return proto.CompactTextString(m) }
+func (*xdsClusterLoadAssignment) ProtoMessage()    {}
+
+type xdsFilter struct {
+	Name        string  `protobuf:"bytes,1,opt,name=name,proto3"`
+	TypedConfig *xdsAny `protobuf:"bytes,4,opt,name=typed_config,proto3"`
+}
+
+type xdsFilterChainMatch struct {
+	ServerNames []string `protobuf:"bytes,11,rep,name=server_names,proto3"`
+}
+
+type xdsTransportSocket struct {
+	Name        string  `protobuf:"bytes,1,opt,name=name,proto3"`
+	TypedConfig *xdsAny `protobuf:"bytes,3,opt,name=typed_config,proto3"`
+}
+
+type xdsFilterChain struct {
+	FilterChainMatch *xdsFilterChainMatch `protobuf:"bytes,1,opt,name=filter_chain_match,proto3"`
+	Filters          []*xdsFilter         `protobuf:"bytes,3,rep,name=filters,proto3"`
+	TransportSocket  *xdsTransportSocket  `protobuf:"bytes,6,opt,name=transport_socket,proto3"`
+}
+
+type xdsListener struct {
+	Name         string            `protobuf:"bytes,1,opt,name=name,proto3"`
+	Address      *xdsAddress       `protobuf:"bytes,2,opt,name=address,proto3"`
+	FilterChains []*xdsFilterChain `protobuf:"bytes,3,rep,name=filter_chains,proto3"`
+}
+
+func (m *xdsListener) Reset()         { *m = xdsListener{} }
+func (m *xdsListener) String() string { return proto.CompactTextString(m) }
+func (*xdsListener) ProtoMessage()    {}
+
+type xdsHTTPFilter struct {
+	Name        string  `protobuf:"bytes,1,opt,name=name,proto3"`
+	TypedConfig *xdsAny `protobuf:"bytes,4,opt,name=typed_config,proto3"`
+}
+
+type xdsRDS struct {
+	ConfigSource    *xdsConfigSource `protobuf:"bytes,1,opt,name=config_source,proto3"`
+	RouteConfigName string           `protobuf:"bytes,2,opt,name=route_config_name,proto3"`
+}
+
+type xdsHTTPConnectionManager struct {
+	StatPrefix  string           `protobuf:"bytes,2,opt,name=stat_prefix,proto3"`
+	RDS         *xdsRDS          `protobuf:"bytes,3,opt,name=rds,proto3"`
+	HTTPFilters []*xdsHTTPFilter `protobuf:"bytes,5,rep,name=http_filters,proto3"`
+}
+
+func (m *xdsHTTPConnectionManager) Reset()         { *m = xdsHTTPConnectionManager{} }
+func (m *xdsHTTPConnectionManager) String() string { return proto.CompactTextString(m) }
+func (*xdsHTTPConnectionManager) ProtoMessage()    {}
+
+type xdsRouter struct{}
+
+func (m *xdsRouter) Reset()         { *m = xdsRouter{} }
+func (m *xdsRouter) String() string { return proto.CompactTextString(m) }
+func (*xdsRouter) ProtoMessage()    {}
+
+type xdsTCPProxy struct {
+	StatPrefix string `protobuf:"bytes,1,opt,name=stat_prefix,proto3"`
+	Cluster    string `protobuf:"bytes,2,opt,name=cluster,proto3"`
+}
+
+func (m *xdsTCPProxy) Reset()         { *m = xdsTCPProxy{} }
+func (m *xdsTCPProxy) String() string { return proto.CompactTextString(m) }
+func (*xdsTCPProxy) ProtoMessage()    {}
+
+type xdsTLSCertificate struct {
+	CertificateChain *xdsDataSource `protobuf:"bytes,1,opt,name=certificate_chain,proto3"`
+	PrivateKey       *xdsDataSource `protobuf:"bytes,2,opt,name=private_key,proto3"`
+}
+
+type xdsCommonTLSContext struct {
+	TLSCertificates []*xdsTLSCertificate `protobuf:"bytes,2,rep,name=tls_certificates,proto3"`
+}
+
+type xdsDownstreamTLSContext struct {
+	CommonTLSContext *xdsCommonTLSContext `protobuf:"bytes,1,opt,name=common_tls_context,proto3"`
+}
+
+func (m *xdsDownstreamTLSContext) Reset()         { *m = xdsDownstreamTLSContext{} }
+func (m *xdsDownstreamTLSContext) String() string { return proto.CompactTextString(m) }
+func (*xdsDownstreamTLSContext) ProtoMessage()    {}
+
+type xdsRegexMatcher struct {
+	Regex string `protobuf:"bytes,2,opt,name=regex,proto3"`
+}
+
+type xdsRegexMatchAndSubstitute struct {
+	Pattern      *xdsRegexMatcher `protobuf:"bytes,1,opt,name=pattern,proto3"`
+	Substitution string           `protobuf:"bytes,2,opt,name=substitution,proto3"`
+}
+
+type xdsRouteMatch struct {
+	Prefix    string           `protobuf:"bytes,1,opt,name=prefix,proto3"`
+	SafeRegex *xdsRegexMatcher `protobuf:"bytes,10,opt,name=safe_regex,proto3"`
+}
+
+type xdsRouteAction struct {
+	Cluster      string                      `protobuf:"bytes,1,opt,name=cluster,proto3"`
+	Timeout      *xdsDuration                `protobuf:"bytes,8,opt,name=timeout,proto3"`
+	RegexRewrite *xdsRegexMatchAndSubstitute `protobuf:"bytes,32,opt,name=regex_rewrite,proto3"`
+}
+
+type xdsRoute struct {
+	Match *xdsRouteMatch  `protobuf:"bytes,1,opt,name=match,proto3"`
+	Route *xdsRouteAction `protobuf:"bytes,2,opt,name=route,proto3"`
+}
+
+type xdsVirtualHost struct {
+	Name    string      `protobuf:"bytes,1,opt,name=name,proto3"`
+	Domains []string    `protobuf:"bytes,2,rep,name=domains,proto3"`
+	Routes  []*xdsRoute `protobuf:"bytes,3,rep,name=routes,proto3"`
+}
+
+type xdsRouteConfiguration struct {
+	Name         string            `protobuf:"bytes,1,opt,name=name,proto3"`
+	VirtualHosts []*xdsVirtualHost `protobuf:"bytes,2,rep,name=virtual_hosts,proto3"`
+}
+
+func (m *xdsRouteConfiguration) Reset()         { *m = xdsRouteConfiguration{} }
+func (m *xdsRouteConfiguration) String() string { return proto.CompactTextString(m) }
+func (*xdsRouteConfiguration) ProtoMessage()    {}